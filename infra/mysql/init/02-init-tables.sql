@@ -3,12 +3,26 @@ USE csv;
 
 --
 -- Компании
+-- external_id - ID компании из выгрузки (колонка "ID"), по нему сопоставляются одноименные компании
+-- name_key - название компании без external_id: такие компании сопоставляются по названию, поэтому оно уникально,
+--            и параллельные импорты не могут создать две одноименные компании
+-- deleted_at - время удаления компании, отсутствующей в полной выгрузке (режим sync)
+-- import_batch_id - импорт, добавивший строку (import_batch), есть также у контактов и связей
+-- updated_batch_id - последний импорт, изменивший уже существовавшую компанию (upsert, sync, сопоставление)
 --
 CREATE TABLE IF NOT EXISTS company (
     id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, 
+    external_id BIGINT UNSIGNED DEFAULT NULL,
     name VARCHAR(255) NOT NULL,
-
-    UNIQUE INDEX UIX_company_name (name)
+    name_key VARCHAR(255) GENERATED ALWAYS AS (IF(external_id IS NULL, name, NULL)) STORED,
+    deleted_at DATETIME DEFAULT NULL,
+    import_batch_id INT DEFAULT NULL,
+    updated_batch_id INT DEFAULT NULL,
+
+    UNIQUE INDEX UIX_company_external_id (external_id),
+    UNIQUE INDEX UIX_company_name_key (name_key),
+    INDEX IX_company_name (name),
+    INDEX IX_company_import_batch (import_batch_id)
 );
 
 --
@@ -19,11 +33,13 @@ CREATE TABLE IF NOT EXISTS company_contact (
     company_id INT NOT NULL,
     phone VARCHAR(150) DEFAULT NULL,
     email VARCHAR(150) DEFAULT NULL,
+    import_batch_id INT DEFAULT NULL,
 
     CONSTRAINT FK_company_phone 
     FOREIGN KEY (company_id) REFERENCES company(id) ON DELETE CASCADE,
     
-    INDEX IX_phone (phone)
+    INDEX IX_phone (phone),
+    INDEX IX_company_contact_import_batch (import_batch_id)
 );
 
 -- 
@@ -85,6 +101,7 @@ CREATE TABLE IF NOT EXISTS company_geo (
     id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, 
     geo_id INT NOT NULL,
     company_id INT NOT NULL,
+    import_batch_id INT DEFAULT NULL,
 
     CONSTRAINT FK_company_geo_company 
     FOREIGN KEY (company_id) REFERENCES company(id) ON DELETE CASCADE,
@@ -92,7 +109,8 @@ CREATE TABLE IF NOT EXISTS company_geo (
     CONSTRAINT FK_company_geo_geo 
     FOREIGN KEY (geo_id) REFERENCES geo(id) ON DELETE CASCADE,
 
-    UNIQUE INDEX UIX_company_geo (company_id, geo_id)
+    UNIQUE INDEX UIX_company_geo (company_id, geo_id),
+    INDEX IX_company_geo_import_batch (import_batch_id)
 );
 
 --
@@ -121,6 +139,7 @@ CREATE TABLE IF NOT EXISTS subcategory (
 CREATE TABLE IF NOT EXISTS company_category (
     company_id INT NOT NULL,
     category_id INT NOT NULL,
+    import_batch_id INT DEFAULT NULL,
 
     PRIMARY KEY (company_id, category_id),
 
@@ -128,7 +147,9 @@ CREATE TABLE IF NOT EXISTS company_category (
     FOREIGN KEY (company_id) REFERENCES company(id) ON DELETE CASCADE,
 
     CONSTRAINT FK_category
-    FOREIGN KEY (category_id) REFERENCES category(id) ON DELETE CASCADE
+    FOREIGN KEY (category_id) REFERENCES category(id) ON DELETE CASCADE,
+
+    INDEX IX_company_category_import_batch (import_batch_id)
 );
 
 --
@@ -137,6 +158,7 @@ CREATE TABLE IF NOT EXISTS company_category (
 CREATE TABLE IF NOT EXISTS company_subcategory (
     company_id INT NOT NULL,
     subcategory_id INT NOT NULL,
+    import_batch_id INT DEFAULT NULL,
 
     PRIMARY KEY (company_id, subcategory_id),
 
@@ -144,5 +166,68 @@ CREATE TABLE IF NOT EXISTS company_subcategory (
     FOREIGN KEY (company_id) REFERENCES company(id) ON DELETE CASCADE,
 
     CONSTRAINT FK_subcategory
-    FOREIGN KEY (subcategory_id) REFERENCES subcategory(id) ON DELETE CASCADE
+    FOREIGN KEY (subcategory_id) REFERENCES subcategory(id) ON DELETE CASCADE,
+
+    INDEX IX_company_subcategory_import_batch (import_batch_id)
+);
+
+--
+-- Задачи импорта CSV файлов
+-- Воркер обновляет статус: queued -> parsing -> inserting -> done | failed
+-- Повторно полученный файл помечается как skipped со ссылкой на исходную задачу
+--
+CREATE TABLE IF NOT EXISTS import_job (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    message_id VARCHAR(255) DEFAULT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(1024) NOT NULL,
+    file_size BIGINT NOT NULL DEFAULT 0,
+    priority VARCHAR(20) DEFAULT NULL,
+    status ENUM('queued', 'parsing', 'inserting', 'done', 'failed', 'skipped') NOT NULL DEFAULT 'queued',
+    worker_id VARCHAR(255) DEFAULT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    rows_processed INT NOT NULL DEFAULT 0,
+    rows_total INT NOT NULL DEFAULT 0,
+    rows_rejected INT NOT NULL DEFAULT 0,
+    rejects_path VARCHAR(1024) DEFAULT NULL,
+    summary JSON DEFAULT NULL,
+    error TEXT DEFAULT NULL,
+    queued_at DATETIME DEFAULT NULL,
+    started_at DATETIME DEFAULT NULL,
+    finished_at DATETIME DEFAULT NULL,
+    duration_ms INT DEFAULT NULL,
+    duplicate_of INT DEFAULT NULL,
+
+    INDEX IX_import_job_status (status),
+    INDEX IX_import_job_message (message_id)
+);
+
+--
+-- Импортированные файлы для защиты от повторной обработки
+-- Запись добавляется в транзакции импорта, поэтому существует только для закоммиченных файлов
+--
+CREATE TABLE IF NOT EXISTS import_dedup (
+    content_hash CHAR(64) NOT NULL PRIMARY KEY,
+    message_id VARCHAR(255) DEFAULT NULL,
+    job_id INT DEFAULT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    imported_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    INDEX IX_import_dedup_message (message_id)
+);
+
+--
+-- Импорты для отката: компании, контакты и связи, добавленные импортом, помечаются его ID
+-- updated_companies - количество существовавших компаний, измененных импортом: такой импорт не откатывается
+--
+CREATE TABLE IF NOT EXISTS import_batch (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    job_id INT DEFAULT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    content_hash CHAR(64) DEFAULT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    rolled_back_at DATETIME DEFAULT NULL,
+    updated_companies INT NOT NULL DEFAULT 0,
+
+    INDEX IX_import_batch_job (job_id)
 );
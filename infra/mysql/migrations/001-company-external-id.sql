@@ -0,0 +1,16 @@
+-- Сопоставление компаний по ID из выгрузки (external_id) вместо уникального названия
+-- Для БД, созданной до появления external_id. Выполняется один раз:
+--   make mysql-migrate FILE=mysql/migrations/001-company-external-id.sql
+--
+-- Уникальный индекс name_key не создастся, если в БД есть одноименные компании без external_id.
+-- До появления external_id названия были уникальны, поэтому для таких БД проверка ничего не находит:
+--   SELECT name, COUNT(*) FROM csv.company WHERE external_id IS NULL GROUP BY name HAVING COUNT(*) > 1;
+USE csv;
+
+ALTER TABLE company
+    DROP INDEX UIX_company_name,
+    ADD COLUMN external_id BIGINT UNSIGNED DEFAULT NULL AFTER id,
+    ADD COLUMN name_key VARCHAR(255) GENERATED ALWAYS AS (IF(external_id IS NULL, name, NULL)) STORED AFTER name,
+    ADD UNIQUE INDEX UIX_company_external_id (external_id),
+    ADD UNIQUE INDEX UIX_company_name_key (name_key),
+    ADD INDEX IX_company_name (name);
@@ -0,0 +1,7 @@
+-- Пометка удаления компаний, отсутствующих в полной выгрузке (режим sync)
+-- Для БД, созданной до появления режима sync. Выполняется один раз:
+--   make mysql-migrate FILE=mysql/migrations/002-company-deleted-at.sql
+USE csv;
+
+ALTER TABLE company
+    ADD COLUMN deleted_at DATETIME DEFAULT NULL AFTER name_key;
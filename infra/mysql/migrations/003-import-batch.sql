@@ -0,0 +1,37 @@
+-- Пометка строк импортом (import_batch) для отката командой worker rollback
+-- Для БД, созданной до появления отката импорта. Выполняется один раз:
+--   make mysql-migrate FILE=mysql/migrations/003-import-batch.sql
+USE csv;
+
+CREATE TABLE IF NOT EXISTS import_batch (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    job_id INT DEFAULT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    content_hash CHAR(64) DEFAULT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    rolled_back_at DATETIME DEFAULT NULL,
+    updated_companies INT NOT NULL DEFAULT 0,
+
+    INDEX IX_import_batch_job (job_id)
+);
+
+ALTER TABLE company
+    ADD COLUMN import_batch_id INT DEFAULT NULL AFTER deleted_at,
+    ADD COLUMN updated_batch_id INT DEFAULT NULL AFTER import_batch_id,
+    ADD INDEX IX_company_import_batch (import_batch_id);
+
+ALTER TABLE company_contact
+    ADD COLUMN import_batch_id INT DEFAULT NULL AFTER email,
+    ADD INDEX IX_company_contact_import_batch (import_batch_id);
+
+ALTER TABLE company_geo
+    ADD COLUMN import_batch_id INT DEFAULT NULL AFTER company_id,
+    ADD INDEX IX_company_geo_import_batch (import_batch_id);
+
+ALTER TABLE company_category
+    ADD COLUMN import_batch_id INT DEFAULT NULL AFTER category_id,
+    ADD INDEX IX_company_category_import_batch (import_batch_id);
+
+ALTER TABLE company_subcategory
+    ADD COLUMN import_batch_id INT DEFAULT NULL AFTER subcategory_id,
+    ADD INDEX IX_company_subcategory_import_batch (import_batch_id);
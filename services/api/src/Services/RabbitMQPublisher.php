@@ -72,6 +72,8 @@ class RabbitMQPublisher
             [
                 'delivery_mode' => 2,
                 'priority' => $messagePriority,
+                // Уникальный ID сообщения, по которому воркер отбрасывает повторные доставки
+                'message_id' => bin2hex(random_bytes(16)),
             ]
         );
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Поля GisCompany, которые можно сопоставить с колонками CSV
+const (
+	FieldExternalID  = "external_id"
+	FieldName        = "name"
+	FieldRegion      = "region"
+	FieldDistrict    = "district"
+	FieldCity        = "city"
+	FieldEmail       = "email"
+	FieldPhone       = "phone"
+	FieldCategory    = "category"
+	FieldSubcategory = "subcategory"
+)
+
+// companyFields - все поддерживаемые поля в порядке их описания в GisCompany
+var companyFields = []string{
+	FieldExternalID,
+	FieldName,
+	FieldRegion,
+	FieldDistrict,
+	FieldCity,
+	FieldEmail,
+	FieldPhone,
+	FieldCategory,
+	FieldSubcategory,
+}
+
+// ColumnMapping описывает соответствие полей GisCompany заголовкам колонок CSV
+//
+// Пример:
+//
+//	{
+//	  "fields": {
+//	    "name": ["Название", "Наименование", "Name"],
+//	    "phone": ["Телефон", "Phone"]
+//	  },
+//	  "required": ["name"]
+//	}
+type ColumnMapping struct {
+	// Fields - поле -> заголовок колонки и его алиасы (используется первый найденный)
+	Fields map[string][]string `json:"fields"`
+	// Required - поля, без колонок которых файл не импортируется
+	Required []string `json:"required,omitempty"`
+}
+
+// DefaultColumnMapping возвращает сопоставление для выгрузок 2GIS
+func DefaultColumnMapping() *ColumnMapping {
+	return &ColumnMapping{
+		Fields: map[string][]string{
+			FieldExternalID:  {"ID"},
+			FieldName:        {"Название"},
+			FieldRegion:      {"Регион"},
+			FieldDistrict:    {"Район"},
+			FieldCity:        {"Город"},
+			FieldEmail:       {"Email"},
+			FieldPhone:       {"Телефон"},
+			FieldCategory:    {"Рубрика"},
+			FieldSubcategory: {"Подрубрика"},
+		},
+		Required: []string{FieldName},
+	}
+}
+
+// LoadColumnMapping загружает сопоставление колонок из JSON файла.
+// Поля, не указанные в файле, берутся из DefaultColumnMapping
+func LoadColumnMapping(path string) (*ColumnMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла сопоставления колонок: %w", err)
+	}
+
+	var mapping ColumnMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("ошибка разбора файла сопоставления колонок: %w", err)
+	}
+
+	if err := mapping.Validate(); err != nil {
+		return nil, err
+	}
+
+	return DefaultColumnMapping().Merge(&mapping), nil
+}
+
+// Validate проверяет, что в сопоставлении указаны только известные поля
+func (m *ColumnMapping) Validate() error {
+	for field, headers := range m.Fields {
+		if !isCompanyField(field) {
+			return fmt.Errorf("неизвестное поле в сопоставлении колонок: %s", field)
+		}
+		if len(headers) == 0 {
+			return fmt.Errorf("для поля %s не указаны заголовки колонок", field)
+		}
+	}
+	for _, field := range m.Required {
+		if !isCompanyField(field) {
+			return fmt.Errorf("неизвестное обязательное поле в сопоставлении колонок: %s", field)
+		}
+	}
+	return nil
+}
+
+// Merge возвращает новое сопоставление, в котором поля из override заменяют текущие.
+// Список обязательных полей заменяется, только если он указан в override
+func (m *ColumnMapping) Merge(override *ColumnMapping) *ColumnMapping {
+	merged := &ColumnMapping{
+		Fields:   make(map[string][]string, len(m.Fields)),
+		Required: m.Required,
+	}
+	for field, headers := range m.Fields {
+		merged.Fields[field] = headers
+	}
+
+	if override == nil {
+		return merged
+	}
+	for field, headers := range override.Fields {
+		merged.Fields[field] = headers
+	}
+	if len(override.Required) > 0 {
+		merged.Required = override.Required
+	}
+
+	return merged
+}
+
+// resolve находит индексы колонок для каждого поля по заголовкам файла.
+// Заголовки сравниваются без учета регистра и пробелов по краям
+func (m *ColumnMapping) resolve(headers []string) (map[string]int, error) {
+	headerIndex := make(map[string]int, len(headers))
+	for i, header := range headers {
+		key := strings.ToLower(strings.TrimSpace(header))
+		if _, exists := headerIndex[key]; !exists {
+			headerIndex[key] = i
+		}
+	}
+
+	columns := make(map[string]int, len(m.Fields))
+	for field, aliases := range m.Fields {
+		for _, alias := range aliases {
+			if i, ok := headerIndex[strings.ToLower(strings.TrimSpace(alias))]; ok {
+				columns[field] = i
+				break
+			}
+		}
+	}
+
+	for _, field := range m.Required {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("в файле нет обязательной колонки для поля %s (ожидается одна из: %s)",
+				field, strings.Join(m.Fields[field], ", "))
+		}
+	}
+
+	return columns, nil
+}
+
+func isCompanyField(field string) bool {
+	for _, f := range companyFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
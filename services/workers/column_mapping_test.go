@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestColumnMappingResolve(t *testing.T) {
+	mapping := DefaultColumnMapping().Merge(&ColumnMapping{
+		Fields: map[string][]string{
+			FieldName:  {"Название", "Наименование"},
+			FieldPhone: {"Phone", "Телефон"},
+		},
+		Required: []string{FieldName, FieldCity},
+	})
+
+	// Заголовки сравниваются без учета регистра и пробелов, используется первый найденный алиас
+	columns, err := mapping.resolve([]string{" наименование ", "ГОРОД", "Телефон", "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns[FieldName] != 0 || columns[FieldCity] != 1 || columns[FieldPhone] != 3 {
+		t.Errorf("неверные индексы колонок: %v", columns)
+	}
+	if _, ok := columns[FieldEmail]; ok {
+		t.Errorf("колонка email не должна быть найдена: %v", columns)
+	}
+
+	_, err = mapping.resolve([]string{"Название", "Регион"})
+	if err == nil || !strings.Contains(err.Error(), FieldCity) {
+		t.Errorf("ожидалась ошибка об отсутствии колонки city, получено: %v", err)
+	}
+
+	// Без списка обязательных полей в override остается список по умолчанию
+	if merged := mapping.Merge(&ColumnMapping{Fields: map[string][]string{FieldEmail: {"Почта"}}}); len(merged.Required) != 2 {
+		t.Errorf("обязательные поля: получено %v", merged.Required)
+	}
+}
+
+func TestLoadColumnMapping(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "mapping.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	mapping, err := LoadColumnMapping(write(`{"fields": {"name": ["Name"]}, "required": ["name", "phone"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(mapping.Fields[FieldName], ",") != "Name" {
+		t.Errorf("name: получено %v", mapping.Fields[FieldName])
+	}
+	// Поля, не указанные в файле, берутся из сопоставления по умолчанию
+	if strings.Join(mapping.Fields[FieldCity], ",") != "Город" {
+		t.Errorf("city: получено %v", mapping.Fields[FieldCity])
+	}
+	if strings.Join(mapping.Required, ",") != "name,phone" {
+		t.Errorf("обязательные поля: получено %v", mapping.Required)
+	}
+
+	invalid := map[string]string{
+		"неизвестное поле":         `{"fields": {"fax": ["Факс"]}}`,
+		"поле без заголовков":      `{"fields": {"name": []}}`,
+		"неизвестное обязательное": `{"required": ["fax"]}`,
+		"некорректный JSON":        `{"fields": `,
+	}
+	for name, content := range invalid {
+		if _, err := LoadColumnMapping(write(content)); err == nil {
+			t.Errorf("%s: ожидалась ошибка", name)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Задержки между попытками переподключения к RabbitMQ
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// AMQPConnection - соединение с RabbitMQ, общее для потребителей одной очереди.
+// Каждый потребитель открывает на нем свой канал. Если соединение оборвалось,
+// его восстанавливает первый потребитель, запросивший новый канал
+type AMQPConnection struct {
+	url       string
+	queueName string
+	conn      *amqp.Connection
+	dialed    bool
+	closed    bool
+	mu        sync.Mutex
+	logger    *slog.Logger
+}
+
+// NewAMQPConnection создает соединение для потребителей очереди. Подключение выполняется
+// при первом запросе канала
+func NewAMQPConnection(url string, queueName string) *AMQPConnection {
+	return &AMQPConnection{
+		url:       url,
+		queueName: queueName,
+		logger:    slog.Default().With(logFieldQueue, queueName),
+	}
+}
+
+// Channel открывает новый канал, при необходимости заново подключаясь к RabbitMQ
+func (c *AMQPConnection) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("соединение с RabbitMQ закрыто")
+	}
+
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка подключения к RabbitMQ: %w", err)
+		}
+		if c.dialed {
+			amqpReconnects.WithLabelValues(c.queueName).Inc()
+			c.logger.Info("Соединение с RabbitMQ восстановлено")
+		}
+		c.conn = conn
+		c.dialed = true
+		amqpConnected.WithLabelValues(c.queueName).Set(1)
+
+		// Обрыв соединения сразу отражается в метрике, не дожидаясь переподключения потребителей
+		closeNotify := conn.NotifyClose(make(chan *amqp.Error, 1))
+		go func() {
+			<-closeNotify
+			amqpConnected.WithLabelValues(c.queueName).Set(0)
+		}()
+	}
+
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания канала: %w", err)
+	}
+	return ch, nil
+}
+
+// IsClosed сообщает, что соединение не установлено или оборвалось
+func (c *AMQPConnection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn == nil || c.conn.IsClosed()
+}
+
+// Close закрывает соединение. Вызывается после остановки всех потребителей очереди
+func (c *AMQPConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// connect открывает канал на общем соединении очереди, применяет Qos и объявляет топологию очереди.
+// Вызывается при старте и после каждой потери соединения или канала
+func (w *Worker) connect() error {
+	ch, err := w.connection.Channel()
+	if err != nil {
+		return err
+	}
+
+	// Устанавливаем prefetch count (настройка канала, применяется заново после переподключения)
+	if err := ch.Qos(w.prefetchCount, 0, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("ошибка установки Qos: %w", err)
+	}
+
+	if err := w.declareTopology(ch); err != nil {
+		ch.Close()
+		return err
+	}
+
+	// Закрытие канала сообщается и при закрытии соединения, поэтому достаточно подписки на канал
+	closeNotify := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Воркер могли остановить, пока шло подключение
+	if w.closing {
+		ch.Close()
+		return fmt.Errorf("воркер остановлен")
+	}
+
+	w.channel = ch
+	w.closeNotify = closeNotify
+
+	return nil
+}
+
+// declareTopology объявляет рабочую очередь, dead-letter очередь, exchange результатов и очереди задержки
+func (w *Worker) declareTopology(ch *amqp.Channel) error {
+	// Определяем аргументы очереди в зависимости от её типа
+	args := make(amqp.Table)
+
+	// Устанавливаем x-max-priority в зависимости от очереди
+	switch w.queueName {
+	case "csv_import_high":
+		args["x-max-priority"] = 10
+	case "csv_import_normal":
+		args["x-max-priority"] = 5
+	case "csv_import_large":
+		args["x-max-priority"] = 1
+	}
+
+	// Объявляем очередь (не создаем, если уже существует)
+	if _, err := ch.QueueDeclare(
+		w.queueName, // name
+		true,        // durable
+		false,       // delete when unused
+		false,       // exclusive
+		false,       // no-wait
+		args,        // arguments
+	); err != nil {
+		return fmt.Errorf("ошибка объявления очереди: %w", err)
+	}
+
+	// Объявляем очередь для задач, которые не удалось обработать
+	if err := declareDeadLetter(ch, w.deadLetterExchange, w.deadLetterQueue); err != nil {
+		return err
+	}
+
+	// Объявляем exchange для событий о завершении импорта
+	if err := declareResultExchange(ch, w.resultExchange); err != nil {
+		return err
+	}
+
+	// Объявляем очереди задержки для повторных попыток
+	return declareRetryQueues(ch, w.queueName, w.retryPolicy)
+}
+
+// reconnect закрывает старый канал и открывает новый с экспоненциальной задержкой.
+// Возвращает false, если воркер остановлен во время ожидания
+func (w *Worker) reconnect() bool {
+	w.closeChannel()
+
+	delay := reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-w.done:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := w.connect()
+		if err == nil {
+			w.logger.Info("Канал RabbitMQ восстановлен", "attempt", attempt)
+			return true
+		}
+		w.logger.Warn("Попытка переподключения не удалась", "attempt", attempt, "error", err)
+
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// currentChannel возвращает актуальный канал для публикации
+func (w *Worker) currentChannel() *amqp.Channel {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.channel
+}
+
+// isClosing сообщает, начата ли остановка воркера (Shutdown или Close)
+func (w *Worker) isClosing() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.closing
+}
+
+// closeChannel закрывает текущий канал, если он еще открыт. Общее соединение очереди не закрывается
+func (w *Worker) closeChannel() error {
+	w.mu.RLock()
+	ch := w.channel
+	w.mu.RUnlock()
+
+	if ch != nil && !ch.IsClosed() {
+		return ch.Close()
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// Поддерживаемые кодировки CSV файлов
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingCP1251  = "windows-1251"
+	EncodingKOI8R   = "koi8-r"
+	formatSniffSize = 64 * 1024
+)
+
+// utf8BOM - маркер порядка байтов UTF-8
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// delimiterCandidates - разделители, среди которых выбирается наиболее частый в заголовке
+var delimiterCandidates = []rune{';', ',', '\t', '|'}
+
+// normalizeEncoding приводит название кодировки из задачи к одному из поддерживаемых
+func normalizeEncoding(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return "", nil
+	case "utf-8", "utf8":
+		return EncodingUTF8, nil
+	case "windows-1251", "cp1251", "cp-1251", "win-1251":
+		return EncodingCP1251, nil
+	case "koi8-r", "koi8r", "koi8":
+		return EncodingKOI8R, nil
+	default:
+		return "", fmt.Errorf("неподдерживаемая кодировка: %s", name)
+	}
+}
+
+// parseDelimiter разбирает разделитель из задачи (один символ или "tab")
+func parseDelimiter(value string) (rune, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if strings.EqualFold(value, "tab") || value == `\t` {
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return 0, fmt.Errorf("разделитель должен быть одним символом: %q", value)
+	}
+	r, _ := utf8.DecodeRuneInString(value)
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("недопустимый разделитель: %q", value)
+	}
+	return r, nil
+}
+
+// detectEncoding определяет кодировку по началу файла (без BOM).
+// Если байты не являются корректным UTF-8, различает CP1251 и KOI8-R
+// по частоте строчных букв: в CP1251 они занимают 0xE0-0xFF, в KOI8-R - 0xC0-0xDF
+func detectEncoding(sample []byte) string {
+	// Последний символ выборки мог быть обрезан посередине
+	valid := sample
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) {
+		return EncodingUTF8
+	}
+
+	upperHalf, lowerHalf := 0, 0
+	for _, b := range sample {
+		switch {
+		case b >= 0xE0:
+			upperHalf++
+		case b >= 0xC0:
+			lowerHalf++
+		}
+	}
+	if lowerHalf > upperHalf {
+		return EncodingKOI8R
+	}
+	return EncodingCP1251
+}
+
+// decodingReader оборачивает src в перекодировщик в UTF-8
+func decodingReader(src io.Reader, encoding string) io.Reader {
+	switch encoding {
+	case EncodingCP1251:
+		return transform.NewReader(src, charmap.Windows1251.NewDecoder())
+	case EncodingKOI8R:
+		return transform.NewReader(src, charmap.KOI8R.NewDecoder())
+	default:
+		return src
+	}
+}
+
+// decodeSample перекодирует выборку в UTF-8 для определения разделителя
+func decodeSample(sample []byte, encoding string) []byte {
+	decoded, err := io.ReadAll(decodingReader(bytes.NewReader(sample), encoding))
+	if err != nil {
+		return sample
+	}
+	return decoded
+}
+
+// detectDelimiter выбирает самый частый разделитель в строке заголовков.
+// Символы внутри кавычек не учитываются. Если ни один не найден, используется ';'
+func detectDelimiter(sample []byte) rune {
+	header := sample
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+
+	counts := make(map[rune]int, len(delimiterCandidates))
+	inQuotes := false
+	for _, r := range string(header) {
+		if r == '"' {
+			inQuotes = !inQuotes
+			continue
+		}
+		if !inQuotes {
+			counts[r]++
+		}
+	}
+
+	best, bestCount := ';', 0
+	for _, candidate := range delimiterCandidates {
+		if counts[candidate] > bestCount {
+			best, bestCount = candidate, counts[candidate]
+		}
+	}
+	return best
+}
@@ -1,93 +1,375 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // CSVParser парсит CSV файлы
 type CSVParser struct {
+	// delimiter и encoding определяются по содержимому файла, если не заданы явно
 	delimiter rune
+	encoding  string
+	mapping   *ColumnMapping
+	rules     *ValidationRules
+}
+
+// ParseStats - итоги чтения файла
+type ParseStats struct {
+	// Rows - количество прочитанных строк данных (без заголовка)
+	Rows int
+	// Rejected - количество строк, не прошедших разбор или проверку
+	Rejected int
 }
 
-// NewCSVParser создает новый парсер CSV
-func NewCSVParser() *CSVParser {
+// NewCSVParser создает новый парсер CSV с указанными сопоставлением колонок и правилами проверки.
+// Разделитель, кодировка и BOM определяются автоматически для каждого файла
+func NewCSVParser(mapping *ColumnMapping, rules *ValidationRules) *CSVParser {
+	if mapping == nil {
+		mapping = DefaultColumnMapping()
+	}
+	if rules == nil {
+		rules = DefaultValidationRules()
+	}
 	return &CSVParser{
-		delimiter: ';',
+		mapping: mapping,
+		rules:   rules,
+	}
+}
+
+// WithValidation возвращает копию парсера, в которой заданные в override
+// правила заменяют текущие правила проверки строк
+func (p *CSVParser) WithValidation(override *ValidationRules) *CSVParser {
+	parser := *p
+	parser.rules = p.rules.Merge(override)
+	return &parser
+}
+
+// WithFormat возвращает копию парсера с явно заданными разделителем и кодировкой.
+// Пустое значение оставляет автоматическое определение
+func (p *CSVParser) WithFormat(delimiter string, encoding string) (*CSVParser, error) {
+	parser := *p
+
+	if delimiter != "" {
+		d, err := parseDelimiter(delimiter)
+		if err != nil {
+			return nil, err
+		}
+		parser.delimiter = d
+	}
+
+	if encoding != "" {
+		e, err := normalizeEncoding(encoding)
+		if err != nil {
+			return nil, err
+		}
+		parser.encoding = e
 	}
+
+	return &parser, nil
 }
 
-// ParseFile парсит CSV файл и возвращает массив записей
-func (p *CSVParser) ParseFile(filePath string) ([]GisCompany, error) {
+// WithMapping возвращает копию парсера, в которой поля из override
+// заменяют текущее сопоставление колонок
+func (p *CSVParser) WithMapping(override *ColumnMapping) *CSVParser {
+	parser := *p
+	parser.mapping = p.mapping.Merge(override)
+	return &parser
+}
+
+// CSVRecordReader последовательно читает записи из CSV файла,
+// не загружая весь файл в память
+type CSVRecordReader struct {
+	file      *os.File
+	reader    *csv.Reader
+	headers   []string
+	columns   map[string]int
+	row       []string
+	line      int
+	delimiter rune
+	encoding  string
+}
+
+// Open открывает CSV файл, читает заголовки и сопоставляет их с полями GisCompany.
+// BOM пропускается, содержимое в CP1251 и KOI8-R перекодируется в UTF-8.
+// Возвращает ошибку, если в файле нет колонки для обязательного поля
+func (p *CSVParser) Open(filePath string) (*CSVRecordReader, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка открытия файла: %w", err)
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	reader.Comma = p.delimiter
+	// Определяем формат по началу файла, не сдвигая позицию чтения
+	buffered := bufio.NewReaderSize(file, formatSniffSize)
+	sample, err := buffered.Peek(formatSniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		file.Close()
+		return nil, fmt.Errorf("ошибка чтения файла: %w", err)
+	}
+
+	hasBOM := bytes.HasPrefix(sample, utf8BOM)
+	if hasBOM {
+		sample = sample[len(utf8BOM):]
+		buffered.Discard(len(utf8BOM))
+	}
+
+	encoding := p.encoding
+	if encoding == "" {
+		encoding = EncodingUTF8
+		if !hasBOM {
+			encoding = detectEncoding(sample)
+		}
+	}
+
+	delimiter := p.delimiter
+	if delimiter == 0 {
+		delimiter = detectDelimiter(decodeSample(sample, encoding))
+	}
+
+	reader := csv.NewReader(decodingReader(buffered, encoding))
+	reader.Comma = delimiter
 	reader.LazyQuotes = true
 	reader.TrimLeadingSpace = true
+	// Буфер строки переиспользуется между вызовами Read
+	reader.ReuseRecord = true
 
 	// Читаем заголовки
 	headers, err := reader.Read()
 	if err != nil {
+		file.Close()
 		return nil, fmt.Errorf("ошибка чтения заголовков: %w", err)
 	}
 
-	// Создаем мапу для быстрого поиска индексов колонок
-	headerMap := make(map[string]int)
-	for i, header := range headers {
-		headerMap[strings.TrimSpace(header)] = i
+	// Находим индексы колонок для полей GisCompany
+	columns, err := p.mapping.resolve(headers)
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
 
-	var records []GisCompany
+	return &CSVRecordReader{
+		file:      file,
+		reader:    reader,
+		headers:   append([]string(nil), headers...),
+		columns:   columns,
+		line:      1,
+		delimiter: delimiter,
+		encoding:  encoding,
+	}, nil
+}
+
+// Next возвращает следующую запись файла или io.EOF, если записи закончились.
+// Ошибка разбора строки оборачивает *csv.ParseError, после неё чтение можно продолжать
+func (r *CSVRecordReader) Next() (GisCompany, error) {
+	row, err := r.reader.Read()
+	if err == io.EOF {
+		return GisCompany{}, io.EOF
+	}
+	r.row = row
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		r.line = parseErr.StartLine
+	} else if len(row) > 0 {
+		r.line, _ = r.reader.FieldPos(0)
+	}
+	if err != nil {
+		return GisCompany{}, fmt.Errorf("ошибка чтения строки %d: %w", r.line, err)
+	}
+
+	// Создаем GisCompany из строки CSV
+	return GisCompany{
+		ExternalID:  normalizeExternalID(r.getField(row, FieldExternalID)),
+		Name:        r.getField(row, FieldName),
+		Region:      r.getField(row, FieldRegion),
+		District:    r.getField(row, FieldDistrict),
+		City:        r.getField(row, FieldCity),
+		Email:       r.getField(row, FieldEmail),
+		Phone:       r.getField(row, FieldPhone),
+		Category:    r.getField(row, FieldCategory),
+		Subcategory: r.getField(row, FieldSubcategory),
+	}, nil
+}
+
+// Headers возвращает заголовки колонок файла
+func (r *CSVRecordReader) Headers() []string {
+	return r.headers
+}
+
+// Row возвращает копию исходных колонок последней прочитанной строки
+func (r *CSVRecordReader) Row() []string {
+	return append([]string(nil), r.row...)
+}
+
+// Line возвращает номер последней прочитанной строки файла (заголовок - строка 1)
+func (r *CSVRecordReader) Line() int {
+	return r.line
+}
+
+// Delimiter возвращает разделитель, с которым читается файл
+func (r *CSVRecordReader) Delimiter() rune {
+	return r.delimiter
+}
+
+// Encoding возвращает исходную кодировку файла
+func (r *CSVRecordReader) Encoding() string {
+	return r.encoding
+}
+
+// Close закрывает файл
+func (r *CSVRecordReader) Close() error {
+	return r.file.Close()
+}
+
+// getField получает значение поля из строки CSV
+func (r *CSVRecordReader) getField(row []string, field string) string {
+	if i, ok := r.columns[field]; ok && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+// normalizeExternalID приводит числовой ID к каноническому виду (без ведущих нулей),
+// чтобы он совпадал со значением, прочитанным из БД. Некорректный ID возвращается как есть
+// и отклоняется при проверке строки
+func normalizeExternalID(value string) string {
+	if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return strconv.FormatUint(id, 10)
+	}
+	return value
+}
+
+// ParseFileInBatches читает CSV файл порциями по batchSize записей и передает их в handle.
+// Срез порции переиспользуется, поэтому handle не должен сохранять его после возврата.
+// Строки, которые не удалось разобрать или не прошедшие проверку, не попадают в порции
+// и передаются в reject (если он задан).
+// Чтение каждой порции записывается в трассировку отдельным span'ом CSVParser.ReadBatch, который
+// завершается до вызова handle, чтобы время вставки не считалось временем чтения файла.
+// Итоги чтения (csv.rows, csv.rejected) добавляются к span'у из ctx
+func (p *CSVParser) ParseFileInBatches(ctx context.Context, filePath string, batchSize int, handle func(batch []GisCompany) error, reject func(rejected RejectedRow) error) (ParseStats, error) {
+	startRead := func() trace.Span {
+		_, span := tracer.Start(ctx, "CSVParser.ReadBatch", trace.WithAttributes(
+			attribute.String("file.path", filePath),
+			attribute.Int("csv.batch_size", batchSize),
+		))
+		return span
+	}
+
+	span := startRead()
+	stats, err := p.parseFileInBatches(filePath, batchSize, func(batch []GisCompany) error {
+		span.SetAttributes(attribute.Int("csv.batch.records", len(batch)))
+		span.End()
+
+		if err := handle(batch); err != nil {
+			span = nil
+			return err
+		}
+		span = startRead()
+		return nil
+	}, reject)
+
+	// Ошибку обработки порции записывает span обработчика, span чтения уже завершен
+	if span != nil {
+		endSpan(span, err)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("csv.rows", stats.Rows),
+		attribute.Int("csv.rejected", stats.Rejected),
+	)
+	return stats, err
+}
+
+// parseFileInBatches читает файл порциями без трассировки
+func (p *CSVParser) parseFileInBatches(filePath string, batchSize int, handle func(batch []GisCompany) error, reject func(rejected RejectedRow) error) (ParseStats, error) {
+	var stats ParseStats
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	reader, err := p.Open(filePath)
+	if err != nil {
+		return stats, err
+	}
+	defer reader.Close()
+
+	batch := make([]GisCompany, 0, batchSize)
 
-	// Читаем данные
 	for {
-		row, err := reader.Read()
+		record, err := reader.Next()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			return nil, fmt.Errorf("ошибка чтения строки: %w", err)
+
+		var reasons []string
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			reasons = []string{fmt.Sprintf("ошибка разбора строки: %v", parseErr.Err)}
+		} else if err != nil {
+			return stats, err
+		} else {
+			reasons = p.rules.Check(record)
 		}
 
-		// Создаем мапу для текущей строки
-		rowMap := make(map[string]string)
-		for i, header := range headers {
-			if i < len(row) {
-				rowMap[strings.TrimSpace(header)] = strings.TrimSpace(row[i])
+		stats.Rows++
+
+		if len(reasons) > 0 {
+			stats.Rejected++
+			if reject != nil {
+				rejected := RejectedRow{
+					Headers: reader.Headers(),
+					Line:    reader.Line(),
+					Row:     reader.Row(),
+					Reasons: reasons,
+				}
+				if err := reject(rejected); err != nil {
+					return stats, err
+				}
 			}
+			continue
 		}
 
-		// Создаем GisCompany из строки CSV
-		company := GisCompany{
-			Name:        p.getField(rowMap, headerMap, "Название"),
-			Region:      p.getField(rowMap, headerMap, "Регион"),
-			District:    p.getField(rowMap, headerMap, "Район"),
-			City:        p.getField(rowMap, headerMap, "Город"),
-			Email:       p.getField(rowMap, headerMap, "Email"),
-			Phone:       p.getField(rowMap, headerMap, "Телефон"),
-			Category:    p.getField(rowMap, headerMap, "Рубрика"),
-			Subcategory: p.getField(rowMap, headerMap, "Подрубрика"),
+		batch = append(batch, record)
+
+		if len(batch) == batchSize {
+			if err := handle(batch); err != nil {
+				return stats, err
+			}
+			batch = batch[:0]
 		}
+	}
 
-		records = append(records, company)
+	if len(batch) > 0 {
+		if err := handle(batch); err != nil {
+			return stats, err
+		}
 	}
 
-	return records, nil
+	return stats, nil
 }
 
-// getField получает значение поля из строки CSV
-func (p *CSVParser) getField(rowMap map[string]string, headerMap map[string]int, fieldName string) string {
-	if val, ok := rowMap[fieldName]; ok {
-		return val
+// ParseFile парсит CSV файл и возвращает массив записей, прошедших проверку.
+// Для больших файлов следует использовать ParseFileInBatches
+func (p *CSVParser) ParseFile(ctx context.Context, filePath string) ([]GisCompany, error) {
+	var records []GisCompany
+
+	_, err := p.ParseFileInBatches(ctx, filePath, 1000, func(batch []GisCompany) error {
+		records = append(records, batch...)
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
 	}
-	return ""
-}
 
+	return records, nil
+}
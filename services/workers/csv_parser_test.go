@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const testCSV = "ID;Название;Регион;Город;Телефон;Email;Рубрика\n" +
+	"1;Mon cher, кафе-кондитерская;Новосибирская область;Новосибирск;+7 (383) 218-33-85;mon-cher2@mail.ru;Общественное питание\n" +
+	"2;Неаполь;Новосибирская область;Новосибирск;;;Продукты питания\n"
+
+// writeTestFile сохраняет содержимое во временный файл
+func writeTestFile(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("ошибка записи файла: %v", err)
+	}
+	return path
+}
+
+func TestCSVParserDetectsFormat(t *testing.T) {
+	cp1251, err := charmap.Windows1251.NewEncoder().String(testCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	koi8r, err := charmap.KOI8R.NewEncoder().String(testCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1251Comma, err := charmap.Windows1251.NewEncoder().String(
+		"ID,Название,Регион\n1,\"Mon cher, кафе-кондитерская\",Новосибирская область\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		content   []byte
+		encoding  string
+		delimiter rune
+	}{
+		{"utf-8", []byte(testCSV), EncodingUTF8, ';'},
+		{"utf-8 с BOM", append(append([]byte{}, utf8BOM...), testCSV...), EncodingUTF8, ';'},
+		{"windows-1251", []byte(cp1251), EncodingCP1251, ';'},
+		{"koi8-r", []byte(koi8r), EncodingKOI8R, ';'},
+		{"windows-1251 с запятой", []byte(cp1251Comma), EncodingCP1251, ','},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := NewCSVParser(nil, nil).Open(writeTestFile(t, tt.content))
+			if err != nil {
+				t.Fatalf("ошибка открытия: %v", err)
+			}
+			defer reader.Close()
+
+			if reader.Encoding() != tt.encoding {
+				t.Errorf("кодировка: ожидалась %s, получена %s", tt.encoding, reader.Encoding())
+			}
+			if reader.Delimiter() != tt.delimiter {
+				t.Errorf("разделитель: ожидался %q, получен %q", tt.delimiter, reader.Delimiter())
+			}
+
+			record, err := reader.Next()
+			if err != nil {
+				t.Fatalf("ошибка чтения: %v", err)
+			}
+			if record.ExternalID != "1" {
+				t.Errorf("ID: получено %q", record.ExternalID)
+			}
+			if record.Name != "Mon cher, кафе-кондитерская" {
+				t.Errorf("название: получено %q", record.Name)
+			}
+			if record.Region != "Новосибирская область" {
+				t.Errorf("регион: получено %q", record.Region)
+			}
+		})
+	}
+}
+
+func TestCSVParserFormatOverride(t *testing.T) {
+	cp1251, err := charmap.Windows1251.NewEncoder().String(testCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser, err := NewCSVParser(nil, nil).WithFormat(";", "cp1251")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := parser.Open(writeTestFile(t, []byte(cp1251)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	record, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.City != "Новосибирск" {
+		t.Errorf("город: получено %q", record.City)
+	}
+
+	if _, err := NewCSVParser(nil, nil).WithFormat(";;", ""); err == nil {
+		t.Error("ожидалась ошибка для разделителя из двух символов")
+	}
+	if _, err := NewCSVParser(nil, nil).WithFormat("", "latin1"); err == nil {
+		t.Error("ожидалась ошибка для неподдерживаемой кодировки")
+	}
+}
+
+func TestCSVParserParseFileInBatches(t *testing.T) {
+	var content strings.Builder
+	content.WriteString("Название;Город\n")
+	for i := 0; i < 25; i++ {
+		content.WriteString("Компания;Новосибирск\n")
+	}
+
+	var batches []int
+	stats, err := NewCSVParser(nil, nil).ParseFileInBatches(context.Background(), writeTestFile(t, []byte(content.String())), 10,
+		func(batch []GisCompany) error {
+			batches = append(batches, len(batch))
+			return nil
+		}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Rows != 25 || stats.Rejected != 0 {
+		t.Errorf("ожидалось 25 записей без отклоненных, получено %+v", stats)
+	}
+	if len(batches) != 3 || batches[0] != 10 || batches[1] != 10 || batches[2] != 5 {
+		t.Errorf("неверное разбиение на порции: %v", batches)
+	}
+}
+
+func TestCSVParserStopsOnHandlerError(t *testing.T) {
+	var content strings.Builder
+	content.WriteString("Название;Город\n")
+	for i := 0; i < 25; i++ {
+		content.WriteString("Компания;Новосибирск\n")
+	}
+
+	// Ошибка обработки порции прерывает чтение: следующие порции не читаются
+	handlerErr := errors.New("ошибка вставки")
+	calls := 0
+	stats, err := NewCSVParser(nil, nil).ParseFileInBatches(context.Background(), writeTestFile(t, []byte(content.String())), 10,
+		func(batch []GisCompany) error {
+			calls++
+			return handlerErr
+		}, nil)
+	if !errors.Is(err, handlerErr) {
+		t.Fatalf("ожидалась ошибка обработчика, получено: %v", err)
+	}
+	if calls != 1 || stats.Rows != 10 {
+		t.Errorf("ожидался один вызов после 10 строк, получено вызовов %d, строк %d", calls, stats.Rows)
+	}
+}
+
+func TestCSVParserParseFile(t *testing.T) {
+	records, err := NewCSVParser(nil, nil).ParseFile(context.Background(), writeTestFile(t, []byte(testCSV)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Порции копируются: записи не перезаписываются при чтении следующих строк
+	if len(records) != 2 || records[0].Name != "Mon cher, кафе-кондитерская" || records[1].Name != "Неаполь" {
+		t.Fatalf("неверные записи: %+v", records)
+	}
+	if records[0].Phone != "+7 (383) 218-33-85" || records[0].Category != "Общественное питание" {
+		t.Errorf("неверные поля первой записи: %+v", records[0])
+	}
+
+	if _, err := NewCSVParser(nil, nil).ParseFile(context.Background(), filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("ожидалась ошибка для отсутствующего файла")
+	}
+}
+
+func TestCSVParserMissingRequiredColumn(t *testing.T) {
+	_, err := NewCSVParser(nil, nil).Open(writeTestFile(t, []byte("Наименование;Город\nКомпания;Новосибирск\n")))
+	if err == nil || !strings.Contains(err.Error(), FieldName) {
+		t.Fatalf("ожидалась ошибка об отсутствии колонки name, получено: %v", err)
+	}
+
+	parser := NewCSVParser(nil, nil).WithMapping(&ColumnMapping{
+		Fields: map[string][]string{FieldName: {"Название", "наименование"}},
+	})
+	reader, err := parser.Open(writeTestFile(t, []byte("Наименование;Город\nКомпания;Новосибирск\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	record, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Name != "Компания" || record.City != "Новосибирск" {
+		t.Errorf("неверная запись: %+v", record)
+	}
+}
+
+func TestCSVParserRejectsInvalidRows(t *testing.T) {
+	content := "Название;Город;Email;Телефон\n" +
+		"Компания 1;Новосибирск;info@example.ru;+7 (383) 218-33-85\n" +
+		";Новосибирск;;\n" +
+		"Компания 3;Новосибирск;not-an-email;\n" +
+		"Компания 4;Новосибирск\n" +
+		"Компания 5;Новосибирск;;+7‒952‒933‒77‒82, 12\n" +
+		"Компания 6;" + strings.Repeat("я", 256) + ";;\n" +
+		"Компания 7;Новосибирск;;\n"
+	path := writeTestFile(t, []byte(content))
+
+	var imported []string
+	rejects := NewRejectsWriter(path)
+	stats, err := NewCSVParser(nil, nil).ParseFileInBatches(context.Background(), path, 100, func(batch []GisCompany) error {
+		for _, record := range batch {
+			imported = append(imported, record.Name)
+		}
+		return nil
+	}, rejects.Write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Rows != 7 || stats.Rejected != 5 {
+		t.Errorf("ожидалось 7 строк и 5 отклоненных, получено %+v", stats)
+	}
+	if strings.Join(imported, ",") != "Компания 1,Компания 7" {
+		t.Errorf("импортированы не те строки: %v", imported)
+	}
+
+	data, err := os.ReadFile(rejects.Path())
+	if err != nil {
+		t.Fatalf("файл отклоненных строк не создан: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("ожидалось 6 строк в файле отклоненных (с заголовком), получено %d:\n%s", len(lines), data)
+	}
+	expected := []string{"3;пустое название", "4;некорректный email", "5;ошибка разбора строки", "6;некорректный телефон: 12", "7;поле city длиннее 255"}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i+1], prefix) {
+			t.Errorf("строка %d: ожидалось начало %q, получено %q", i+1, prefix, lines[i+1])
+		}
+	}
+
+	// Без отклоненных строк файл не создается
+	clean := writeTestFile(t, []byte("Название\nКомпания\n"))
+	cleanRejects := NewRejectsWriter(clean)
+	if _, err := NewCSVParser(nil, nil).ParseFileInBatches(context.Background(), clean, 10, func([]GisCompany) error { return nil }, cleanRejects.Write); err != nil {
+		t.Fatal(err)
+	}
+	cleanRejects.Close()
+	if _, err := os.Stat(cleanRejects.Path()); !os.IsNotExist(err) {
+		t.Errorf("файл отклоненных строк не должен создаваться: %v", err)
+	}
+	// Повторная попытка по исправленному файлу удаляет отклоненные строки прошлой попытки
+	if err := os.WriteFile(path, []byte("Название\nКомпания\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	retryRejects := NewRejectsWriter(path)
+	if err := retryRejects.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCSVParser(nil, nil).ParseFileInBatches(context.Background(), path, 10, func([]GisCompany) error { return nil }, retryRejects.Write); err != nil {
+		t.Fatal(err)
+	}
+	retryRejects.Close()
+	if _, err := os.Stat(retryRejects.Path()); !os.IsNotExist(err) {
+		t.Errorf("файл отклоненных строк прошлой попытки не удален: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlErrDuplicateKey - код ошибки MySQL ER_DUP_ENTRY
+const mysqlErrDuplicateKey = 1062
+
+// ErrAlreadyImported - файл уже импортирован другой задачей, закоммиченной раньше
+var ErrAlreadyImported = errors.New("файл уже импортирован")
+
+// ImportRecord - запись об успешно импортированном файле
+type ImportRecord struct {
+	ContentHash string
+	MessageID   string
+	JobID       int64
+	FileName    string
+	ImportedAt  time.Time
+}
+
+// DedupRepository хранит контрольные суммы и MessageId импортированных файлов
+// в таблице import_dedup, чтобы не импортировать один и тот же файл повторно
+type DedupRepository struct {
+	db *sql.DB
+}
+
+// NewDedupRepository создает новый экземпляр репозитория
+func NewDedupRepository(db *sql.DB) *DedupRepository {
+	return &DedupRepository{db: db}
+}
+
+// Find ищет импорт с той же контрольной суммой файла или тем же MessageId.
+// Возвращает nil, если файл еще не импортировался
+func (r *DedupRepository) Find(contentHash string, messageID string) (*ImportRecord, error) {
+	row := r.db.QueryRow(
+		`SELECT content_hash, message_id, job_id, file_name, imported_at
+		FROM csv.import_dedup
+		WHERE content_hash = ? OR (? <> '' AND message_id = ?)
+		LIMIT 1`,
+		contentHash, messageID, messageID,
+	)
+
+	var record ImportRecord
+	var storedMessageID sql.NullString
+	var jobID sql.NullInt64
+	if err := row.Scan(&record.ContentHash, &storedMessageID, &jobID, &record.FileName, &record.ImportedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ошибка проверки повторного импорта: %w", err)
+	}
+	record.MessageID = storedMessageID.String
+	record.JobID = jobID.Int64
+
+	return &record, nil
+}
+
+// Record сохраняет импорт в транзакции tx, чтобы запись появилась только вместе с данными.
+// Если тот же файл параллельно импортирует другая задача, вставка ждет её коммита и возвращает
+// ErrAlreadyImported: транзакция импорта должна быть откачена. При принудительном повторном
+// импорте (force) существующая запись обновляется
+func (r *DedupRepository) Record(tx *sql.Tx, contentHash string, messageID string, jobID int64, fileName string, force bool) error {
+	var job interface{}
+	if jobID > 0 {
+		job = jobID
+	}
+
+	query := `INSERT INTO csv.import_dedup (content_hash, message_id, job_id, file_name, imported_at)
+		VALUES (?, ?, ?, ?, NOW())`
+	if force {
+		query += `
+		ON DUPLICATE KEY UPDATE message_id = VALUES(message_id), job_id = VALUES(job_id),
+			file_name = VALUES(file_name), imported_at = VALUES(imported_at)`
+	}
+
+	_, err := tx.Exec(query, contentHash, nullString(messageID), job, fileName)
+	if isDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", ErrAlreadyImported, contentHash)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения контрольной суммы файла: %w", err)
+	}
+	return nil
+}
+
+// isDuplicateKeyError проверяет, что вставка нарушила уникальный ключ
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateKey
+}
+
+// fileChecksum вычисляет SHA-256 содержимого файла
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("ошибка открытия файла: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("ошибка чтения файла: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+const testContentHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestDedupRecordConcurrentDuplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Вторая задача с тем же файлом доходит до коммита после первой: вставка без
+	// ON DUPLICATE KEY получает ошибку уникального ключа, и вся транзакция импорта откатывается
+	mock.ExpectBegin()
+	mock.ExpectExec("SET FOREIGN_KEY_CHECKS = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET FOREIGN_KEY_CHECKS = 1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO csv.import_dedup (content_hash, message_id, job_id, file_name, imported_at)")+`\s+VALUES \(\?, \?, \?, \?, NOW\(\)\)$`).
+		WithArgs(testContentHash, "message-2", int64(2), "companies.csv").
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrDuplicateKey, Message: "Duplicate entry for key 'PRIMARY'"})
+	mock.ExpectRollback()
+
+	dedup := NewDedupRepository(db)
+	err = NewCompanyRepository(db, 0).InsertStream(context.Background(),
+		func(ctx context.Context, handle func(batch []GisCompany) error) error { return nil },
+		ImportOptions{
+			BeforeCommit: func(tx *sql.Tx) error {
+				return dedup.Record(tx, testContentHash, "message-2", 2, "companies.csv", false)
+			},
+		})
+	if !errors.Is(err, ErrAlreadyImported) {
+		t.Fatalf("ожидалась ошибка ErrAlreadyImported, получено: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDedupRecordForce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Принудительный повторный импорт обновляет запись о файле
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO csv.import_dedup")+`.*ON DUPLICATE KEY UPDATE`).
+		WithArgs(testContentHash, "message-3", int64(3), "companies.csv").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO csv.import_dedup").
+		WillReturnError(errors.New("Error 2006: MySQL server has gone away"))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup := NewDedupRepository(db)
+	if err := dedup.Record(tx, testContentHash, "message-3", 3, "companies.csv", true); err != nil {
+		t.Fatalf("ошибка принудительного повторного импорта: %v", err)
+	}
+
+	// Прочие ошибки вставки не считаются повтором
+	err = dedup.Record(tx, testContentHash, "message-3", 3, "companies.csv", true)
+	if err == nil || errors.Is(err, ErrAlreadyImported) {
+		t.Errorf("ожидалась ошибка сохранения, получено: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
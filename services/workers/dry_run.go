@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// dryRunMaxNames - сколько новых значений каждого справочника перечисляется в отчете
+const dryRunMaxNames = 100
+
+// dryRunTables - справочники в отчете проверки. Гео не проверяются: их ID зависят от вставки справочников
+var dryRunTables = []string{"region", "district", "city", "category", "subcategory"}
+
+// DryRunReport - отчет проверочного импорта: что изменится в БД, если импортировать файл
+type DryRunReport struct {
+	DryRun bool `json:"dry_run"`
+
+	// Rows и Rejected - прочитанные и отклоненные проверкой строки файла
+	Rows        int    `json:"rows"`
+	Rejected    int    `json:"rejected"`
+	RejectsPath string `json:"rejects_path,omitempty"`
+
+	// Companies - новые и уже существующие компании файла
+	Companies EntryCount `json:"companies"`
+
+	// Dictionaries - новые и существующие значения по справочникам (region, district, city, category, subcategory)
+	Dictionaries map[string]*EntryCount `json:"dictionaries"`
+
+	// NewValues - новые значения справочников, не более dryRunMaxNames на справочник
+	NewValues map[string][]string `json:"new_values,omitempty"`
+
+	// Truncated - количество значений по полям, которые не помещаются в колонку БД.
+	// Такие телефоны и email пропускаются, остальные поля MySQL в строгом режиме не примет
+	Truncated map[string]int `json:"truncated,omitempty"`
+
+	// AlreadyImported - файл уже был импортирован в задаче DuplicateOf
+	AlreadyImported bool  `json:"already_imported,omitempty"`
+	DuplicateOf     int64 `json:"duplicate_of,omitempty"`
+}
+
+// dryRunState - уже учтенные в отчете значения, чтобы повторы в разных порциях не считались дважды
+type dryRunState struct {
+	report       *DryRunReport
+	dictionaries map[string]map[string]bool
+	companies    map[string]bool
+	columnSizes  map[string]int
+}
+
+// DryRun проверяет записи из source, ничего не записывая в БД: справочники и компании
+// только ищутся в БД в транзакции READ ONLY, которая затем откатывается.
+// Строки файла и отклоненные строки заполняет вызывающий по статистике парсера
+func (r *CompanyRepository) DryRun(ctx context.Context, source RecordSource) (*DryRunReport, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	r.beginImport(ImportOptions{})
+
+	ctx, span := tracer.Start(ctx, "import.dry_run")
+	r.ctx = ctx
+	defer func() {
+		r.ctx = context.Background()
+	}()
+
+	state := &dryRunState{
+		report: &DryRunReport{
+			DryRun:       true,
+			Dictionaries: make(map[string]*EntryCount),
+			NewValues:    make(map[string][]string),
+			Truncated:    make(map[string]int),
+		},
+		dictionaries: make(map[string]map[string]bool),
+		companies:    make(map[string]bool),
+		// Ограничения по умолчанию соответствуют размерам колонок в схеме БД
+		columnSizes: DefaultValidationRules().MaxLength,
+	}
+	for _, table := range dryRunTables {
+		state.dictionaries[table] = make(map[string]bool)
+		state.report.Dictionaries[table] = &EntryCount{}
+	}
+
+	if err := source(ctx, func(batch []GisCompany) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return r.traceStep("import.batch", func() error {
+			return r.dryRunBatch(tx, state, batch)
+		}, attribute.Int("import.batch.records", len(batch)))
+	}); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	endSpan(span, nil)
+
+	for _, names := range state.report.NewValues {
+		sort.Strings(names)
+	}
+	return state.report, nil
+}
+
+// dryRunBatch добавляет в отчет одну порцию записей
+func (r *CompanyRepository) dryRunBatch(tx *sql.Tx, state *dryRunState, records []GisCompany) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := r.dryRunDictionaries(tx, state, records); err != nil {
+		return fmt.Errorf("ошибка проверки справочников: %w", err)
+	}
+
+	if err := r.dryRunCompanies(tx, state, records); err != nil {
+		return fmt.Errorf("ошибка проверки компаний: %w", err)
+	}
+
+	for _, record := range records {
+		state.countTruncated(record)
+	}
+
+	r.trimCaches()
+	return nil
+}
+
+// dryRunDictionaries ищет значения справочников порции в кэше и БД
+func (r *CompanyRepository) dryRunDictionaries(tx *sql.Tx, state *dryRunState, records []GisCompany) error {
+	uniqueValues := r.collectDictionaryValues(records)
+
+	for _, table := range dryRunTables {
+		seen := state.dictionaries[table]
+
+		names := make([]string, 0, len(uniqueValues[table]))
+		for name := range uniqueValues[table] {
+			if !seen[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		if err := r.loadDictionaryFromDB(tx, table, names); err != nil {
+			return err
+		}
+
+		count := state.report.Dictionaries[table]
+		cache := r.getCacheForTable(table)
+		for _, name := range names {
+			seen[name] = true
+			if _, exists := cache.Get(name); exists {
+				count.Existing++
+				continue
+			}
+			count.New++
+			if len(state.report.NewValues[table]) < dryRunMaxNames {
+				state.report.NewValues[table] = append(state.report.NewValues[table], name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dryRunCompanies ищет компании порции в БД так же, как batchInsertCompanies, но без вставки.
+// Компании без ID, которым импорт присвоит ID из выгрузки, считаются существующими
+func (r *CompanyRepository) dryRunCompanies(tx *sql.Tx, state *dryRunState, records []GisCompany) error {
+	byExternalID := make(map[string]string)
+	byName := make([]string, 0)
+	for _, record := range records {
+		key := r.companyKey(record)
+		if record.Name == "" || state.companies[key] {
+			continue
+		}
+		state.companies[key] = true
+		if record.ExternalID != "" {
+			byExternalID[record.ExternalID] = record.Name
+		} else {
+			byName = append(byName, record.Name)
+		}
+	}
+
+	externalIDs := make([]string, 0, len(byExternalID))
+	for externalID := range byExternalID {
+		externalIDs = append(externalIDs, externalID)
+	}
+
+	if err := r.loadCompaniesByExternalID(tx, externalIDs); err != nil {
+		return err
+	}
+	if err := r.loadCompaniesByName(tx, byName); err != nil {
+		return err
+	}
+
+	missingIDs := r.missingCompanies(externalIDs, "id:")
+	claims, err := r.findClaimableCompanies(tx, missingIDs, byExternalID)
+	if err != nil {
+		return err
+	}
+
+	newCompanies := len(missingIDs) - len(claims) + len(r.missingCompanies(byName, "name:"))
+	state.report.Companies.New += newCompanies
+	state.report.Companies.Existing += len(externalIDs) + len(byName) - newCompanies
+	return nil
+}
+
+// countTruncated считает значения записи, которые не помещаются в колонку БД
+func (s *dryRunState) countTruncated(record GisCompany) {
+	scalars := []struct {
+		field string
+		value string
+	}{
+		{FieldName, record.Name},
+		{FieldRegion, record.Region},
+		{FieldDistrict, record.District},
+		{FieldCity, record.City},
+	}
+	for _, scalar := range scalars {
+		s.checkSize(scalar.field, scalar.value)
+	}
+
+	lists := []struct {
+		field string
+		value string
+	}{
+		{FieldEmail, record.Email},
+		{FieldPhone, record.Phone},
+		{FieldCategory, record.Category},
+		{FieldSubcategory, record.Subcategory},
+	}
+	for _, list := range lists {
+		for _, value := range splitList(list.value) {
+			s.checkSize(list.field, value)
+		}
+	}
+}
+
+// checkSize учитывает значение, если оно длиннее колонки поля
+func (s *dryRunState) checkSize(field string, value string) {
+	if size := s.columnSizes[field]; size > 0 && utf8.RuneCountInString(value) > size {
+		s.report.Truncated[field]++
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthPingTimeout - ограничение времени проверки соединения с БД в /readyz
+const healthPingTimeout = 2 * time.Second
+
+// HealthChecker отвечает на проверки живости (/healthz) и готовности (/readyz) воркеров.
+// Живость нарушена, если текущее сообщение не продвигается дольше stallTimeout:
+// такой процесс нужно перезапустить. Готовность нарушена, если недоступна БД,
+// закрыто соединение или канал RabbitMQ или не зарегистрирован потребитель очереди:
+// процесс может восстановиться сам, но задачи сейчас не обрабатываются
+type HealthChecker struct {
+	db           *sql.DB
+	workers      []*Worker
+	stallTimeout time.Duration
+}
+
+// healthResponse - тело ответа проверки: общий статус и результат по каждой проверке
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealthChecker создает проверки для воркеров. stallTimeout <= 0 отключает проверку зависания
+func NewHealthChecker(db *sql.DB, workers []*Worker, stallTimeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		db:           db,
+		workers:      workers,
+		stallTimeout: stallTimeout,
+	}
+}
+
+// Liveness - обработчик /healthz
+func (h *HealthChecker) Liveness(rw http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string, len(h.workers))
+	for _, w := range h.workers {
+		checks["consume:"+w.workerID] = checkResult(w.checkProgress(time.Now(), h.stallTimeout))
+	}
+	writeHealth(rw, checks)
+}
+
+// Readiness - обработчик /readyz
+func (h *HealthChecker) Readiness(rw http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string, len(h.workers)+1)
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+	defer cancel()
+	checks["database"] = checkResult(h.db.PingContext(ctx))
+
+	for _, w := range h.workers {
+		checks["amqp:"+w.workerID] = checkResult(w.checkReady())
+	}
+	writeHealth(rw, checks)
+}
+
+// checkResult возвращает ok или текст ошибки проверки
+func checkResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// writeHealth отвечает 200, если все проверки прошли, иначе 503
+func writeHealth(rw http.ResponseWriter, checks map[string]string) {
+	response := healthResponse{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			response.Status = "fail"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(response)
+}
+
+// touchProgress отмечает продвижение текущего сообщения: начало обработки или очередную порцию записей
+func (w *Worker) touchProgress() {
+	w.progressAt.Store(time.Now().UnixNano())
+}
+
+// clearProgress снимает отметку после завершения обработки сообщения
+func (w *Worker) clearProgress() {
+	w.progressAt.Store(0)
+}
+
+// checkProgress возвращает ошибку, если сообщение обрабатывается, но не продвигается дольше stallTimeout
+func (w *Worker) checkProgress(now time.Time, stallTimeout time.Duration) error {
+	progressAt := w.progressAt.Load()
+	if progressAt == 0 || stallTimeout <= 0 {
+		return nil
+	}
+
+	if idle := now.Sub(time.Unix(0, progressAt)); idle > stallTimeout {
+		return fmt.Errorf("обработка сообщения не продвигается %s", idle.Round(time.Second))
+	}
+	return nil
+}
+
+// setConsuming отмечает, зарегистрирован ли потребитель на текущем канале
+func (w *Worker) setConsuming(consuming bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.consuming == consuming {
+		return
+	}
+	w.consuming = consuming
+	if consuming {
+		consumersRegistered.WithLabelValues(w.queueName).Inc()
+	} else {
+		consumersRegistered.WithLabelValues(w.queueName).Dec()
+	}
+}
+
+// checkReady возвращает ошибку, если воркер сейчас не может получать сообщения
+func (w *Worker) checkReady() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	switch {
+	case w.closing:
+		return fmt.Errorf("воркер останавливается")
+	case w.connection == nil || w.connection.IsClosed():
+		return fmt.Errorf("соединение с RabbitMQ закрыто")
+	case w.channel == nil || w.channel.IsClosed():
+		return fmt.Errorf("канал RabbitMQ закрыт")
+	case !w.consuming:
+		return fmt.Errorf("потребитель очереди не зарегистрирован")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerLivenessDetectsStall(t *testing.T) {
+	w := &Worker{queueName: "csv_import_normal"}
+	health := NewHealthChecker(nil, []*Worker{w}, time.Minute)
+
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		health.Liveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	// Воркер без сообщения в обработке жив
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("простаивающий воркер: ожидался 200, получен %d", code)
+	}
+
+	w.touchProgress()
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("продвигающийся импорт: ожидался 200, получен %d", code)
+	}
+
+	// Последнее продвижение было раньше дедлайна
+	w.progressAt.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("зависший импорт: ожидался 503, получен %d", code)
+	}
+
+	w.clearProgress()
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("после завершения сообщения: ожидался 200, получен %d", code)
+	}
+}
+
+func TestWorkerCheckReady(t *testing.T) {
+	w := &Worker{queueName: "csv_import_normal", done: make(chan struct{})}
+	if err := w.checkReady(); err == nil {
+		t.Error("воркер без соединения не должен быть готов")
+	}
+
+	w.stop()
+	if err := w.checkReady(); err == nil {
+		t.Error("останавливаемый воркер не должен быть готов")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ImportBatch описывает файл, из которого импортируются данные.
+// Компании, контакты и связи, добавленные импортом, помечаются ID записи import_batch
+type ImportBatch struct {
+	JobID       int64
+	FileName    string
+	ContentHash string
+}
+
+// RollbackStats - количество строк, удаленных при откате импорта
+type RollbackStats struct {
+	Companies     int64
+	Contacts      int64
+	Geo           int64
+	Categories    int64
+	Subcategories int64
+}
+
+// batchTables - таблицы с пометкой import_batch_id в порядке удаления при откате:
+// сначала связи и контакты, затем компании
+var batchTables = []string{
+	"company_contact",
+	"company_geo",
+	"company_category",
+	"company_subcategory",
+	"company",
+}
+
+// createBatch создает запись import_batch в транзакции импорта и запоминает её ID
+func (r *CompanyRepository) createBatch(tx *sql.Tx, batch *ImportBatch) error {
+	var jobID interface{}
+	if batch.JobID > 0 {
+		jobID = batch.JobID
+	}
+
+	result, err := r.execSQL(tx,
+		"INSERT INTO csv.import_batch (job_id, file_name, content_hash) VALUES (?, ?, ?)",
+		jobID, batch.FileName, nullString(batch.ContentHash),
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка создания записи import_batch: %w", err)
+	}
+
+	batchID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("ошибка создания записи import_batch: %w", err)
+	}
+
+	r.mu.Lock()
+	r.batchID = batchID
+	r.mu.Unlock()
+	return nil
+}
+
+// finishBatch помечает существующие компании, измененные импортом (сопоставление по названию, upsert,
+// sync), колонкой updated_batch_id и сохраняет их количество в import_batch. По этим пометкам откат
+// отказывается удалять компании, которые позже изменил другой импорт, и не откатывает импорт, изменения
+// которого нельзя отменить удалением строк
+func (r *CompanyRepository) finishBatch(tx *sql.Tx) error {
+	r.mu.RLock()
+	batchID := r.batchID
+	updated := make([]interface{}, 0, len(r.updatedCompanies))
+	for companyID := range r.updatedCompanies {
+		// Компании, созданные этим импортом, удаляются при откате целиком
+		if !r.createdCompanies[companyID] {
+			updated = append(updated, companyID)
+		}
+	}
+	r.mu.RUnlock()
+
+	for i := 0; i < len(updated); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(updated) {
+			end = len(updated)
+		}
+		chunk := updated[i:end]
+
+		query := fmt.Sprintf("UPDATE csv.company SET updated_batch_id = ? WHERE id IN (%s)", placeholderList(len(chunk)))
+		if _, err := r.execSQL(tx, query, append([]interface{}{batchID}, chunk...)...); err != nil {
+			return fmt.Errorf("ошибка пометки измененных компаний импорта %d: %w", batchID, err)
+		}
+	}
+
+	if _, err := r.execSQL(tx,
+		"UPDATE csv.import_batch SET updated_companies = ? WHERE id = ?",
+		len(updated), batchID,
+	); err != nil {
+		return fmt.Errorf("ошибка обновления записи import_batch: %w", err)
+	}
+	return nil
+}
+
+// batchValue возвращает ID текущего импорта для колонки import_batch_id (NULL, если импорт не помечается)
+func (r *CompanyRepository) batchValue() interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.batchValueLocked()
+}
+
+// batchValueLocked - batchValue для вызова под r.mu
+func (r *CompanyRepository) batchValueLocked() interface{} {
+	if r.batchID == 0 {
+		return nil
+	}
+	return r.batchID
+}
+
+// BatchRepository откатывает импорты по записям import_batch
+type BatchRepository struct {
+	db *sql.DB
+}
+
+// NewBatchRepository создает новый экземпляр репозитория
+func NewBatchRepository(db *sql.DB) *BatchRepository {
+	return &BatchRepository{db: db}
+}
+
+// Rollback удаляет компании, контакты и связи, добавленные импортом batchID.
+// Строки, существовавшие до импорта, не затрагиваются: INSERT IGNORE не меняет их import_batch_id.
+// Откат отклоняется, если импорт изменил существующие компании (upsert, sync, сопоставление по названию),
+// а также если к его компаниям позже добавили строки или их изменил другой импорт: удаление компании
+// каскадно удалило бы чужие контакты и связи.
+// Вместе с импортом удаляется контрольная сумма файла, чтобы его можно было импортировать снова
+func (r *BatchRepository) Rollback(batchID int64) (RollbackStats, error) {
+	var stats RollbackStats
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return stats, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	var jobID sql.NullInt64
+	var contentHash sql.NullString
+	var rolledBackAt sql.NullTime
+	var updatedCompanies int
+	err = tx.QueryRow(
+		"SELECT job_id, content_hash, rolled_back_at, updated_companies FROM csv.import_batch WHERE id = ? FOR UPDATE",
+		batchID,
+	).Scan(&jobID, &contentHash, &rolledBackAt, &updatedCompanies)
+	if err == sql.ErrNoRows {
+		return stats, fmt.Errorf("импорт %d не найден", batchID)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("ошибка загрузки импорта %d: %w", batchID, err)
+	}
+	if rolledBackAt.Valid {
+		return stats, fmt.Errorf("импорт %d уже откачен %s", batchID, rolledBackAt.Time.Format("2006-01-02 15:04:05"))
+	}
+	if updatedCompanies > 0 {
+		return stats, fmt.Errorf("импорт %d изменил существующие компании - %d, такие изменения откатом не отменяются",
+			batchID, updatedCompanies)
+	}
+	if err := checkRollbackConflicts(tx, batchID); err != nil {
+		return stats, err
+	}
+
+	counts := map[string]*int64{
+		"company_contact":     &stats.Contacts,
+		"company_geo":         &stats.Geo,
+		"company_category":    &stats.Categories,
+		"company_subcategory": &stats.Subcategories,
+		"company":             &stats.Companies,
+	}
+	for _, table := range batchTables {
+		result, err := tx.Exec(fmt.Sprintf("DELETE FROM csv.%s WHERE import_batch_id = ?", table), batchID)
+		if err != nil {
+			return stats, fmt.Errorf("ошибка удаления строк %s импорта %d: %w", table, batchID, err)
+		}
+		*counts[table], _ = result.RowsAffected()
+	}
+
+	if contentHash.Valid {
+		if _, err := tx.Exec(
+			"DELETE FROM csv.import_dedup WHERE content_hash = ? AND (job_id <=> ?)",
+			contentHash.String, jobID,
+		); err != nil {
+			return stats, fmt.Errorf("ошибка удаления контрольной суммы импорта %d: %w", batchID, err)
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE csv.import_batch SET rolled_back_at = NOW() WHERE id = ?", batchID); err != nil {
+		return stats, fmt.Errorf("ошибка обновления импорта %d: %w", batchID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return stats, fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+	return stats, nil
+}
+
+// checkRollbackConflicts проверяет, что удаление компаний импорта не затронет данные других импортов.
+// Строки компаний блокируются до конца транзакции, чтобы параллельный импорт не добавил к ним связи
+func checkRollbackConflicts(tx *sql.Tx, batchID int64) error {
+	var changed int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM csv.company WHERE import_batch_id = ? AND updated_batch_id IS NOT NULL AND updated_batch_id <> ? FOR UPDATE",
+		batchID, batchID,
+	).Scan(&changed); err != nil {
+		return fmt.Errorf("ошибка проверки компаний импорта %d: %w", batchID, err)
+	}
+	if changed > 0 {
+		return fmt.Errorf("компании импорта %d изменены другими импортами - %d, откат удалил бы их изменения", batchID, changed)
+	}
+
+	// Все таблицы, кроме company, ссылаются на компанию с ON DELETE CASCADE
+	for _, table := range batchTables[:len(batchTables)-1] {
+		var foreign int
+		if err := tx.QueryRow(fmt.Sprintf(
+			"SELECT COUNT(*) FROM csv.%s t JOIN csv.company c ON c.id = t.company_id "+
+				"WHERE c.import_batch_id = ? AND NOT (t.import_batch_id <=> ?)", table),
+			batchID, batchID,
+		).Scan(&foreign); err != nil {
+			return fmt.Errorf("ошибка проверки строк %s импорта %d: %w", table, batchID, err)
+		}
+		if foreign > 0 {
+			return fmt.Errorf("к компаниям импорта %d добавлены строки %s другими импортами - %d, откат удалил бы их каскадно",
+				batchID, table, foreign)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectRollbackBatch ожидает загрузку записи import_batch в транзакции отката
+func expectRollbackBatch(mock sqlmock.Sqlmock, updatedCompanies int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT job_id, content_hash, rolled_back_at, updated_companies FROM csv.import_batch")).
+		WithArgs(int64(17)).
+		WillReturnRows(sqlmock.NewRows([]string{"job_id", "content_hash", "rolled_back_at", "updated_companies"}).
+			AddRow(int64(42), testContentHash, nil, updatedCompanies))
+}
+
+// expectChildConflicts ожидает проверку таблиц связей с количеством чужих строк в каждой
+func expectChildConflicts(mock sqlmock.Sqlmock, foreign ...int) {
+	for i, count := range foreign {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM csv."+batchTables[i]+" t JOIN csv.company c")).
+			WithArgs(int64(17), int64(17)).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	}
+}
+
+func TestBatchRollbackRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		expect  func(mock sqlmock.Sqlmock)
+		message string
+	}{
+		{
+			name: "импорт изменил существующие компании",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectRollbackBatch(mock, 3)
+			},
+			message: "изменил существующие компании - 3",
+		},
+		{
+			name: "компании изменены другим импортом",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectRollbackBatch(mock, 0)
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM csv.company WHERE import_batch_id = ? AND updated_batch_id")).
+					WithArgs(int64(17), int64(17)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+			message: "изменены другими импортами - 1",
+		},
+		{
+			name: "к компаниям добавлены связи другого импорта",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectRollbackBatch(mock, 0)
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM csv.company WHERE import_batch_id = ? AND updated_batch_id")).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				expectChildConflicts(mock, 0, 0, 2)
+			},
+			message: "строки company_category другими импортами - 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// Ни одна строка не удаляется, транзакция откатывается
+			tt.expect(mock)
+			mock.ExpectRollback()
+
+			_, err = NewBatchRepository(db).Rollback(17)
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("ожидалась ошибка %q, получено: %v", tt.message, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectRollbackBatch(mock, 0)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM csv.company WHERE import_batch_id = ? AND updated_batch_id")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	expectChildConflicts(mock, 0, 0, 0, 0)
+	for i, table := range batchTables {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM csv." + table + " WHERE import_batch_id = ?")).
+			WithArgs(int64(17)).
+			WillReturnResult(sqlmock.NewResult(0, int64(i+1)))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM csv.import_dedup")).
+		WithArgs(testContentHash, int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE csv.import_batch SET rolled_back_at = NOW()")).
+		WithArgs(int64(17)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	stats, err := NewBatchRepository(db).Rollback(17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RollbackStats{Contacts: 1, Geo: 2, Categories: 3, Subcategories: 4, Companies: 5}
+	if stats != expected {
+		t.Errorf("ожидалось %+v, получено %+v", expected, stats)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFinishBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := NewCompanyRepository(db, 0)
+	r.beginImport(ImportOptions{})
+	r.batchID = 17
+	// Компания 2 создана этим импортом и позже изменена им же: она удаляется откатом и не мешает ему
+	r.createdCompanies[2] = true
+	r.updatedCompanies[1] = true
+	r.updatedCompanies[2] = true
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE csv.company SET updated_batch_id = ? WHERE id IN (?)")).
+		WithArgs(int64(17), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE csv.import_batch SET updated_companies = ? WHERE id = ?")).
+		WithArgs(1, int64(17)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.finishBatch(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Статусы задачи импорта в таблице import_job
+const (
+	JobStatusQueued    = "queued"
+	JobStatusParsing   = "parsing"
+	JobStatusInserting = "inserting"
+	JobStatusDone      = "done"
+	JobStatusFailed    = "failed"
+	JobStatusSkipped   = "skipped"
+)
+
+// jobErrorMaxLength - ограничение длины сообщения об ошибке (колонка TEXT)
+const jobErrorMaxLength = 65000
+
+// JobRepository ведет учет задач импорта в таблице import_job.
+// Методы обновления ничего не делают для jobID = 0 (задача не отслеживается)
+type JobRepository struct {
+	db *sql.DB
+}
+
+// NewJobRepository создает новый экземпляр репозитория задач
+func NewJobRepository(db *sql.DB) *JobRepository {
+	return &JobRepository{db: db}
+}
+
+// Create создает запись о задаче в статусе queued и возвращает её ID.
+// Время постановки в очередь берется из created_at задачи
+func (r *JobRepository) Create(task ImportTask, messageID string) (int64, error) {
+	queuedAt := time.Now()
+	if task.CreatedAt != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", task.CreatedAt, time.Local); err == nil {
+			queuedAt = t
+		}
+	}
+
+	result, err := r.db.Exec(
+		`INSERT INTO csv.import_job (message_id, file_name, file_path, file_size, priority, status, queued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		nullString(messageID), task.FileName, task.FilePath, task.FileSize, nullString(task.Priority), JobStatusQueued, queuedAt,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка создания задачи импорта: %w", err)
+	}
+
+	return result.LastInsertId()
+}
+
+// Start переводит задачу в статус parsing и увеличивает счетчик попыток
+func (r *JobRepository) Start(jobID int64, workerID string) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	_, err := r.db.Exec(
+		`UPDATE csv.import_job
+		SET status = ?, worker_id = ?, attempts = attempts + 1, rows_processed = 0, started_at = NOW(), finished_at = NULL, error = NULL
+		WHERE id = ?`,
+		JobStatusParsing, workerID, jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// SetStatus меняет статус задачи
+func (r *JobRepository) SetStatus(jobID int64, status string) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	if _, err := r.db.Exec("UPDATE csv.import_job SET status = ? WHERE id = ?", status, jobID); err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// Progress сохраняет количество строк, переданных в БД с начала текущей попытки
+func (r *JobRepository) Progress(jobID int64, rows int) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	if _, err := r.db.Exec("UPDATE csv.import_job SET rows_processed = ? WHERE id = ?", rows, jobID); err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// Finish переводит задачу в статус done и сохраняет итоги импорта (Summary или DryRunReport)
+func (r *JobRepository) Finish(jobID int64, stats ParseStats, rejectsPath string, summary interface{}, duration time.Duration) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("ошибка сериализации статистики импорта: %w", err)
+	}
+
+	_, err = r.db.Exec(
+		`UPDATE csv.import_job
+		SET status = ?, rows_processed = ?, rows_total = ?, rows_rejected = ?, rejects_path = ?, summary = ?,
+			duration_ms = ?, finished_at = NOW(), error = NULL
+		WHERE id = ?`,
+		JobStatusDone, stats.Rows-stats.Rejected, stats.Rows, stats.Rejected, nullString(rejectsPath), string(summaryJSON),
+		duration.Milliseconds(), jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// Fail сохраняет ошибку попытки. Если final, задача переводится в статус failed,
+// иначе возвращается в статус queued до следующей попытки
+func (r *JobRepository) Fail(jobID int64, cause error, final bool) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	status := JobStatusQueued
+	if final {
+		status = JobStatusFailed
+	}
+
+	// Обрезаем по границе символа, чтобы не получить некорректный UTF-8
+	message := cause.Error()
+	if len(message) > jobErrorMaxLength {
+		message = strings.ToValidUTF8(message[:jobErrorMaxLength], "")
+	}
+
+	_, err := r.db.Exec(
+		`UPDATE csv.import_job
+		SET status = ?, error = ?, finished_at = IF(?, NOW(), NULL),
+			duration_ms = TIMESTAMPDIFF(MICROSECOND, started_at, NOW()) DIV 1000
+		WHERE id = ?`,
+		status, message, final, jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// Skip переводит задачу в статус skipped: файл уже был импортирован в задаче duplicateOf
+func (r *JobRepository) Skip(jobID int64, duplicateOf int64) error {
+	if jobID == 0 {
+		return nil
+	}
+
+	var original interface{}
+	if duplicateOf > 0 {
+		original = duplicateOf
+	}
+
+	_, err := r.db.Exec(
+		`UPDATE csv.import_job
+		SET status = ?, duplicate_of = ?, finished_at = NOW(), error = NULL
+		WHERE id = ?`,
+		JobStatusSkipped, original, jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления задачи импорта %d: %w", jobID, err)
+	}
+	return nil
+}
+
+// nullString возвращает NULL для пустой строки
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
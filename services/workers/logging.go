@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Поля логов, по которым фильтруются записи одного импорта
+const (
+	logFieldWorkerID    = "worker_id"
+	logFieldQueue       = "queue"
+	logFieldMessageID   = "message_id"
+	logFieldJobID       = "job_id"
+	logFieldFileName    = "file_name"
+	logFieldImportBatch = "import_batch"
+)
+
+// NewLogger создает логгер, пишущий в stdout в формате text или json с минимальным уровнем
+// debug, info, warn или error
+func NewLogger(format string, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("неизвестный уровень логов: %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: minLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("неизвестный формат логов: %s", format)
+	}
+}
+
+// fatal пишет ошибку и завершает процесс, как log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
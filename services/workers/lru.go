@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache - кэш "ключ -> ID" ограниченного размера с вытеснением давно не использованных записей.
+// Вытеснение выполняется только в Trim между порциями импорта: значения, загруженные для текущей порции,
+// должны оставаться в кэше до её завершения, поэтому во время порции кэш может превысить capacity
+// на количество уникальных значений порции
+type lruCache struct {
+	capacity int // 0 - без ограничения
+	items    map[string]*list.Element
+	order    *list.List // в начале - недавно использованные
+
+	mu sync.Mutex
+}
+
+type lruEntry struct {
+	key string
+	id  int
+}
+
+// newLRUCache создает кэш на capacity записей (0 - без ограничения)
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get возвращает ID по ключу и отмечает запись как использованную
+func (c *lruCache) Get(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.items[key]
+	if !exists {
+		return 0, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).id, true
+}
+
+// Set сохраняет ID по ключу
+func (c *lruCache) Set(key string, id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.items[key]; exists {
+		element.Value.(*lruEntry).id = id
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, id: id})
+}
+
+// Len возвращает количество записей
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Each вызывает fn для каждой записи без изменения порядка использования
+func (c *lruCache) Each(fn func(key string, id int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*lruEntry)
+		fn(entry.key, entry.id)
+	}
+}
+
+// Trim вытесняет давно не использованные записи сверх capacity и возвращает их количество
+func (c *lruCache) Trim() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return 0
+	}
+
+	evicted := 0
+	for len(c.items) > c.capacity {
+		element := c.order.Back()
+		c.order.Remove(element)
+		delete(c.items, element.Value.(*lruEntry).key)
+		evicted++
+	}
+	return evicted
+}
+
+// Reset удаляет все записи
+func (c *lruCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestLRUCacheTrim(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.Set("Москва", 1)
+	cache.Set("Новосибирск", 2)
+	cache.Set("Омск", 3)
+
+	// До Trim значения текущей порции не вытесняются
+	if cache.Len() != 3 {
+		t.Fatalf("ожидалось 3 записи до Trim, получено %d", cache.Len())
+	}
+
+	// Москва использована последней и должна остаться
+	if id, ok := cache.Get("Москва"); !ok || id != 1 {
+		t.Fatalf("неверное значение Москва: %d %v", id, ok)
+	}
+
+	if evicted := cache.Trim(); evicted != 1 {
+		t.Errorf("ожидалось вытеснение 1 записи, вытеснено %d", evicted)
+	}
+	if _, ok := cache.Get("Новосибирск"); ok {
+		t.Error("давно не использованная запись Новосибирск не вытеснена")
+	}
+	if _, ok := cache.Get("Москва"); !ok {
+		t.Error("недавно использованная запись Москва вытеснена")
+	}
+	if _, ok := cache.Get("Омск"); !ok {
+		t.Error("запись Омск вытеснена")
+	}
+
+	unbounded := newLRUCache(0)
+	unbounded.Set("a", 1)
+	unbounded.Set("b", 2)
+	if unbounded.Trim() != 0 || unbounded.Len() != 2 {
+		t.Error("кэш без ограничения не должен вытеснять записи")
+	}
+}
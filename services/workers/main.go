@@ -1,23 +1,45 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
 	// Загружаем конфигурацию
 	config, err := LoadConfig()
 	if err != nil {
-		log.Fatalf("Ошибка загрузки конфигурации: %v", err)
+		fatal("Ошибка загрузки конфигурации", "error", err)
+	}
+
+	// Логи пишутся в stdout в формате text или json, вывод пакета log идет туда же
+	logger, err := NewLogger(config.LogFormat, config.LogLevel)
+	if err != nil {
+		fatal("Ошибка настройки логов", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	// Трассировка включается, если задан адрес коллектора OTLP
+	var tracerProvider *sdktrace.TracerProvider
+	if config.OTLPEndpoint != "" {
+		tracerProvider, err = InitTracing(context.Background())
+		if err != nil {
+			fatal("Ошибка настройки трассировки", "error", err)
+		}
+		slog.Info("Трассировка включена", "endpoint", config.OTLPEndpoint)
 	}
 
 	// Подключаемся к БД
@@ -26,13 +48,12 @@ func main() {
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.Fatalf("Ошибка подключения к БД: %v", err)
+		fatal("Ошибка подключения к БД", "error", err)
 	}
-	defer db.Close()
 
 	// Проверяем соединение
 	if err := db.Ping(); err != nil {
-		log.Fatalf("Ошибка проверки соединения с БД: %v", err)
+		fatal("Ошибка проверки соединения с БД", "error", err)
 	}
 
 	// Устанавливаем параметры пула соединений
@@ -40,28 +61,54 @@ func main() {
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(5 * 60) // 5 минут
 
-	log.Println("Подключение к БД установлено")
+	slog.Info("Подключение к БД установлено")
+
+	// Команда отката импорта: worker rollback <import_batch_id>
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		err := runRollback(db, os.Args[2:])
+		db.Close()
+		if err != nil {
+			fatal("Ошибка отката импорта", "error", err)
+		}
+		return
+	}
 
 	// Определяем очереди для обработки
 	queues := getQueuesToProcess()
 
 	if len(queues) == 0 {
-		log.Fatalf("Не указаны очереди для обработки. Установите переменную окружения WORKER_QUEUES или используйте значения по умолчанию")
+		fatal("Не указаны очереди для обработки. Установите переменную окружения WORKER_QUEUES или используйте значения по умолчанию")
 	}
 
-	log.Printf("Запуск воркеров для очередей: %s", strings.Join(queues, ", "))
+	slog.Info("Запуск воркеров", "queues", strings.Join(queues, ","))
 
-	// Создаем воркеры для каждой очереди
+	// Создаем потребителей для каждой очереди: общее соединение, у каждого потребителя свой канал.
+	// Соединение закрывается после остановки всех потребителей (defer выполняются в обратном порядке)
 	var workers []*Worker
 	for _, queueName := range queues {
-		worker, err := NewWorker(config, db, queueName)
-		if err != nil {
-			log.Fatalf("Ошибка создания воркера для очереди %s: %v", queueName, err)
+		conn := NewAMQPConnection(config.RabbitMQURL, queueName)
+		defer conn.Close()
+
+		concurrency := config.ConcurrencyFor(queueName)
+		for consumer := 1; consumer <= concurrency; consumer++ {
+			worker, err := NewWorker(config, db, conn, queueName, consumer)
+			if err != nil {
+				fatal("Ошибка создания воркера", logFieldQueue, queueName, "error", err)
+			}
+			workers = append(workers, worker)
+			defer worker.Close()
 		}
-		workers = append(workers, worker)
-		defer worker.Close()
+		slog.Info("Потребители очереди подключены", logFieldQueue, queueName, "concurrency", concurrency)
 	}
 
+	// Служебный HTTP сервер: метрики Prometheus и проверки живости и готовности
+	health := NewHealthChecker(db, workers, config.StallTimeout)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(NewMetricsRegistry(db, config.DBName)))
+	mux.HandleFunc("/healthz", health.Liveness)
+	mux.HandleFunc("/readyz", health.Readiness)
+	httpServer := startHTTPServer(config.HTTPAddr, mux)
+
 	// Обработка сигналов для graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -83,20 +130,93 @@ func main() {
 	// Ждем сигнала завершения или ошибки
 	select {
 	case sig := <-sigChan:
-		log.Printf("Получен сигнал: %v, завершаем работу...", sig)
+		slog.Info("Получен сигнал, ожидаем завершения текущих импортов", "signal", sig.String(), "timeout", config.ShutdownTimeout.String())
+
+		// Воркеры останавливаются параллельно с общим дедлайном
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		var shutdownWg sync.WaitGroup
 		for _, worker := range workers {
-			if err := worker.Close(); err != nil {
-				log.Printf("Ошибка закрытия воркера: %v", err)
-			}
+			shutdownWg.Add(1)
+			go func(w *Worker) {
+				defer shutdownWg.Done()
+				if err := w.Shutdown(ctx); err != nil {
+					w.logger.Error("Ошибка закрытия воркера", "error", err)
+				}
+			}(worker)
 		}
+		shutdownWg.Wait()
+		cancel()
 	case err := <-done:
 		if err != nil {
-			log.Fatalf("Воркер завершился с ошибкой: %v", err)
+			fatal("Воркер завершился с ошибкой", "error", err)
 		}
 	}
 
 	wg.Wait()
-	log.Println("Все воркеры остановлены")
+	slog.Info("Все воркеры остановлены")
+
+	if httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		httpServer.Shutdown(ctx)
+		cancel()
+	}
+
+	// Отправляем накопленные span'ы
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			slog.Error("Ошибка отправки трассировок", "error", err)
+		}
+		cancel()
+	}
+
+	// Пул соединений с БД закрывается только после завершения всех импортов
+	if err := db.Close(); err != nil {
+		slog.Error("Ошибка закрытия соединения с БД", "error", err)
+	}
+}
+
+// startHTTPServer запускает служебный HTTP сервер в отдельной горутине. Пустой addr отключает сервер
+func startHTTPServer(addr string, handler http.Handler) *http.Server {
+	if addr == "" {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Ошибка HTTP сервера", "addr", addr, "error", err)
+		}
+	}()
+
+	slog.Info("Служебный HTTP сервер запущен", "addr", addr)
+	return server
+}
+
+// runRollback откатывает импорт по ID из import_batch
+func runRollback(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("использование: worker rollback <import_batch_id>")
+	}
+
+	batchID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || batchID <= 0 {
+		return fmt.Errorf("некорректный ID импорта: %s", args[0])
+	}
+
+	stats, err := NewBatchRepository(db).Rollback(batchID)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Импорт откачен", logFieldImportBatch, batchID,
+		"companies", stats.Companies, "contacts", stats.Contacts, "geo", stats.Geo,
+		"categories", stats.Categories, "subcategories", stats.Subcategories)
+	return nil
 }
 
 // getQueuesToProcess возвращает список очередей для обработки
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace - префикс имен метрик воркера
+const metricsNamespace = "csv_import"
+
+// Метрики воркера. Метки queue - имя рабочей очереди
+var (
+	messagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_consumed_total",
+		Help:      "Полученные из очереди сообщения, переданные в обработку.",
+	}, []string{"queue"})
+
+	messagesAcked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_acked_total",
+		Help:      "Подтвержденные сообщения (ack).",
+	}, []string{"queue"})
+
+	messagesNacked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_nacked_total",
+		Help:      "Отклоненные сообщения (nack), requeue - возвращены ли они в очередь.",
+	}, []string{"queue", "requeue"})
+
+	messagesRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_retried_total",
+		Help:      "Сообщения, отправленные в очередь задержки для повторной попытки.",
+	}, []string{"queue"})
+
+	messagesDeadLettered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_dead_lettered_total",
+		Help:      "Сообщения, отправленные в dead-letter очередь.",
+	}, []string{"queue"})
+
+	importDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "import_duration_seconds",
+		Help:      "Длительность обработки задачи по итоговому статусу (done, failed, skipped).",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 14), // 0.25с ... ~34 мин
+	}, []string{"queue", "status"})
+
+	importRowsPerSecond = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "import_rows_per_second",
+		Help:      "Скорость последнего успешного импорта в строках в секунду.",
+	}, []string{"queue"})
+
+	rowsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_read_total",
+		Help:      "Прочитанные строки CSV в успешных импортах.",
+	}, []string{"queue"})
+
+	rowsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_rejected_total",
+		Help:      "Строки CSV, отклоненные проверкой.",
+	}, []string{"queue"})
+
+	deadlockRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deadlock_retries_total",
+		Help:      "Повторы после deadlock: dictionary - транзакции предзагрузки справочника, import - импорта целиком.",
+	}, []string{"scope"})
+
+	amqpConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_connected",
+		Help:      "Открыто ли общее соединение потребителей очереди с RabbitMQ (1 - да).",
+	}, []string{"queue"})
+
+	amqpReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_reconnects_total",
+		Help:      "Успешные переподключения к RabbitMQ.",
+	}, []string{"queue"})
+
+	consumersRegistered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consumers",
+		Help:      "Зарегистрированные потребители очереди.",
+	}, []string{"queue"})
+)
+
+// NewMetricsRegistry регистрирует метрики воркера, статистику пула соединений с БД,
+// метрики Go runtime и процесса
+func NewMetricsRegistry(db *sql.DB, dbName string) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		messagesConsumed,
+		messagesAcked,
+		messagesNacked,
+		messagesRetried,
+		messagesDeadLettered,
+		importDuration,
+		importRowsPerSecond,
+		rowsRead,
+		rowsRejected,
+		deadlockRetries,
+		amqpConnected,
+		amqpReconnects,
+		consumersRegistered,
+		collectors.NewDBStatsCollector(db, dbName),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// MetricsHandler возвращает обработчик /metrics для реестра
+func MetricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// observeImport учитывает завершенную задачу в метриках длительности и строк
+func observeImport(queue string, result *ImportResult) {
+	duration := result.FinishedAt.Sub(result.StartedAt).Seconds()
+	importDuration.WithLabelValues(queue, result.Status).Observe(duration)
+
+	var rows, rejected int
+	switch summary := result.Summary.(type) {
+	case Summary:
+		rows, rejected = summary.Rows, summary.Rejected
+	case *DryRunReport:
+		rows, rejected = summary.Rows, summary.Rejected
+	default:
+		return
+	}
+
+	rowsRead.WithLabelValues(queue).Add(float64(rows))
+	rowsRejected.WithLabelValues(queue).Add(float64(rejected))
+	if duration > 0 {
+		importRowsPerSecond.WithLabelValues(queue).Set(float64(rows) / duration)
+	}
+}
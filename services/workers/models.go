@@ -2,6 +2,7 @@ package main
 
 // GisCompany представляет модель компании из CSV
 type GisCompany struct {
+	ExternalID  string
 	Name        string
 	Region      string
 	District    string
@@ -19,16 +20,96 @@ type ImportTask struct {
 	FileSize int    `json:"file_size"`
 	Priority string `json:"priority"`
 	CreatedAt string `json:"created_at"`
+
+	// JobID - ID записи в import_job, если API создал её заранее (необязательно)
+	JobID int64 `json:"job_id,omitempty"`
+
+	// Delimiter и Encoding переопределяют автоматически определенный формат файла (необязательно)
+	Delimiter string `json:"delimiter,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+
+	// ColumnMapping переопределяет сопоставление колонок для этого файла (необязательно)
+	ColumnMapping *ColumnMapping `json:"column_mapping,omitempty"`
+
+	// Validation переопределяет правила проверки строк для этого файла (необязательно)
+	Validation *ValidationRules `json:"validation,omitempty"`
+
+	// Mode - режим импорта: insert (по умолчанию), upsert или sync (необязательно)
+	Mode string `json:"mode,omitempty"`
+
+	// Sync - область полной выгрузки для режима sync
+	Sync *SyncOptions `json:"sync,omitempty"`
+
+	// Force - импортировать файл, даже если он уже был импортирован (необязательно)
+	Force bool `json:"force,omitempty"`
+
+	// DryRun - только проверить файл и сохранить отчет о том, что изменится в БД, ничего не записывая (необязательно)
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// CallbackURL - адрес, на который после импорта отправляется подписанное уведомление (необязательно)
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
-// Summary представляет статистику импорта
+// Summary представляет статистику одного импорта
 type Summary struct {
-	Company      int      `json:"company"`
-	Category     int      `json:"category"`
-	Subcategory  int      `json:"subcategory"`
-	Region       int      `json:"region"`
-	District     int      `json:"district"`
-	City         int      `json:"city"`
-	Errors       []string `json:"errors"`
+	// Rows и Rejected - прочитанные и отклоненные проверкой строки файла
+	Rows     int `json:"rows"`
+	Rejected int `json:"rejected"`
+
+	// Companies - вставленные компании и компании, найденные в БД
+	Companies CompanyCount `json:"companies"`
+
+	// Dictionaries - новые и существующие записи по справочникам: region, district, city, category, subcategory, geo
+	Dictionaries map[string]*EntryCount `json:"dictionaries"`
+
+	// Links - вставленные строки по таблицам связей: company_geo, company_category, company_subcategory, company_contact
+	Links map[string]int `json:"links"`
+
+	Errors []string `json:"errors,omitempty"`
+
+	// Updated и Changes заполняются в режиме upsert: изменения компаний, которые были в БД до импорта.
+	// Changes содержит не более upsertMaxChanges компаний, остальные учитываются в ChangesTruncated
+	Updated          int             `json:"updated,omitempty"`
+	Changes          []CompanyChange `json:"changes,omitempty"`
+	ChangesTruncated int             `json:"changes_truncated,omitempty"`
+
+	// Removed - компании области выгрузки, удаленные или отвязанные в режиме sync,
+	// Restored - ранее удаленные компании, снова появившиеся в выгрузке
+	Removed  int `json:"removed,omitempty"`
+	Restored int `json:"restored,omitempty"`
+
+	// ImportBatch - ID записи import_batch, по которому импорт можно откатить
+	ImportBatch int64 `json:"import_batch_id,omitempty"`
+}
+
+// CompanyCount - вставленные и найденные в БД компании
+type CompanyCount struct {
+	Inserted int `json:"inserted"`
+	Matched  int `json:"matched"`
+}
+
+// EntryCount - количество новых и существующих записей
+type EntryCount struct {
+	New      int `json:"new"`
+	Existing int `json:"existing"`
+}
+
+// CompanyChange описывает изменения одной компании при импорте в режиме upsert
+type CompanyChange struct {
+	CompanyID     int        `json:"company_id"`
+	ExternalID    string     `json:"external_id,omitempty"`
+	Name          string     `json:"name"`
+	OldName       string     `json:"old_name,omitempty"`
+	Phones        *SetChange `json:"phones,omitempty"`
+	Emails        *SetChange `json:"emails,omitempty"`
+	Geo           *SetChange `json:"geo,omitempty"`
+	Categories    *SetChange `json:"categories,omitempty"`
+	Subcategories *SetChange `json:"subcategories,omitempty"`
+}
+
+// SetChange - добавленные и удаленные элементы набора связей компании
+type SetChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
 }
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RejectedRow - строка CSV, не прошедшая разбор или проверку
+type RejectedRow struct {
+	Headers []string
+	Line    int
+	Row     []string
+	Reasons []string
+}
+
+// RejectsWriter записывает отклоненные строки в CSV файл рядом с исходным.
+// Файл создается только при первой отклоненной строке
+type RejectsWriter struct {
+	path   string
+	file   *os.File
+	writer *csv.Writer
+	count  int
+}
+
+// NewRejectsWriter создает writer для отклоненных строк файла sourcePath
+func NewRejectsWriter(sourcePath string) *RejectsWriter {
+	ext := filepath.Ext(sourcePath)
+	return &RejectsWriter{
+		path: strings.TrimSuffix(sourcePath, ext) + ".rejects.csv",
+	}
+}
+
+// Reset удаляет файл отклоненных строк, оставшийся от предыдущей попытки импорта того же файла,
+// чтобы в нем не остались строки, которые текущая попытка не отклоняла
+func (w *RejectsWriter) Reset() error {
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ошибка удаления файла отклоненных строк: %w", err)
+	}
+	return nil
+}
+
+// Write добавляет отклоненную строку: номер строки, причины и исходные колонки
+func (w *RejectsWriter) Write(rejected RejectedRow) error {
+	if w.writer == nil {
+		file, err := os.Create(w.path)
+		if err != nil {
+			return fmt.Errorf("ошибка создания файла отклоненных строк: %w", err)
+		}
+		w.file = file
+		w.writer = csv.NewWriter(file)
+		w.writer.Comma = ';'
+
+		header := append([]string{"Строка", "Причина"}, rejected.Headers...)
+		if err := w.writer.Write(header); err != nil {
+			return fmt.Errorf("ошибка записи файла отклоненных строк: %w", err)
+		}
+	}
+
+	row := append([]string{strconv.Itoa(rejected.Line), strings.Join(rejected.Reasons, "; ")}, rejected.Row...)
+	if err := w.writer.Write(row); err != nil {
+		return fmt.Errorf("ошибка записи файла отклоненных строк: %w", err)
+	}
+
+	w.count++
+	return nil
+}
+
+// Count возвращает количество записанных строк
+func (w *RejectsWriter) Count() int {
+	return w.count
+}
+
+// Path возвращает путь к файлу отклоненных строк
+func (w *RejectsWriter) Path() string {
+	return w.path
+}
+
+// Close сбрасывает буфер и закрывает файл, если он был создан
+func (w *RejectsWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("ошибка записи файла отклоненных строк: %w", err)
+	}
+	return w.file.Close()
+}
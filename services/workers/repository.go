@@ -1,125 +1,182 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"math/rand"
 	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	pivotBatchSize = 5000
+
+	// contactMaxLength - размер колонок phone и email в company_contact
+	contactMaxLength = 150
+)
+
+// Справочники и таблицы связей в статистике импорта
+var (
+	dictionaryTables = []string{"region", "district", "city", "category", "subcategory", "geo"}
+	linkTables       = []string{"company_geo", "company_category", "company_subcategory", "company_contact"}
 )
 
 // CompanyRepository реализует логику работы с БД, аналогичную PHP CompanyRepository
 type CompanyRepository struct {
 	db *sql.DB
 
-	// Кэши справочников
-	region      map[string]int
-	district    map[string]int
-	city        map[string]int
-	category    map[string]int
-	subcategory map[string]int
-	company     map[string]int
-	geoCache    map[string]int
+	// Кэши справочников ограничены по размеру и вытесняют давно не использованные записи
+	region      *lruCache
+	district    *lruCache
+	city        *lruCache
+	category    *lruCache
+	subcategory *lruCache
+	company     *lruCache // ключ - companyKey: ID из выгрузки или название
+	geoCache    *lruCache
 
-	// Для массовой вставки связей
+	// Для массовой вставки связей, очищаются после каждой порции и в начале импорта
 	companyGeos       map[int][]int
 	companyCategories map[int]map[string][]int
-
-	// Статистика
-	companyCount int
-	errors       []string
+	companyContacts   map[int]map[string][]string
+
+	// Состояние текущего импорта, сбрасывается в начале каждой попытки
+	mode             string
+	createdCompanies map[int]bool
+	replacedContacts map[int]bool
+	replacedLinks    map[int]bool
+	changes          map[int]*CompanyChange
+	changeOrder      []int
+	seenCompanies    map[int]bool
+	updatedCompanies map[int]bool // существовавшие до импорта компании, которые он изменил
+	batchID          int64
+	removedCount     int
+	restoredCount    int
+
+	// Статистика текущего импорта
+	dictionarySeen map[string]map[string]bool // значения справочников, уже учтенные в статистике
+	dictionaries   map[string]*EntryCount
+	links          map[string]int
+	errors         []string
+
+	// ctx - контекст текущего этапа импорта: отменяется при остановке воркера
+	// и служит родителем span'ов запросов
+	ctx context.Context
 
 	mu sync.RWMutex
 }
 
-// NewCompanyRepository создает новый экземпляр репозитория
-func NewCompanyRepository(db *sql.DB) *CompanyRepository {
+// NewCompanyRepository создает новый экземпляр репозитория.
+// cacheSize - максимальное количество записей в каждом кэше справочников (0 - без ограничения)
+func NewCompanyRepository(db *sql.DB, cacheSize int) *CompanyRepository {
 	return &CompanyRepository{
 		db:                db,
-		region:            make(map[string]int),
-		district:          make(map[string]int),
-		city:              make(map[string]int),
-		category:          make(map[string]int),
-		subcategory:       make(map[string]int),
-		company:           make(map[string]int),
-		geoCache:          make(map[string]int),
+		region:            newLRUCache(cacheSize),
+		district:          newLRUCache(cacheSize),
+		city:              newLRUCache(cacheSize),
+		category:          newLRUCache(cacheSize),
+		subcategory:       newLRUCache(cacheSize),
+		company:           newLRUCache(cacheSize),
+		geoCache:          newLRUCache(cacheSize),
 		companyGeos:       make(map[int][]int),
 		companyCategories: make(map[int]map[string][]int),
-		errors:            make([]string, 0),
+		companyContacts:   make(map[int]map[string][]string),
+		ctx:               context.Background(),
 	}
 }
 
+// RecordSource поставляет записи для импорта порциями, вызывая handle для каждой порции.
+// При повторной попытке импорта источник вызывается заново, поэтому он должен
+// уметь отдать те же записи повторно (например, перечитать файл).
+// ctx - контекст трассировки попытки импорта
+type RecordSource func(ctx context.Context, handle func(batch []GisCompany) error) error
+
+// Режимы импорта
+const (
+	// ImportModeInsert добавляет новые компании и связи, существующие данные не меняются
+	ImportModeInsert = "insert"
+	// ImportModeUpsert дополнительно обновляет название существующих компаний и заменяет
+	// их контакты, гео и категории наборами из файла
+	ImportModeUpsert = "upsert"
+	// ImportModeSync работает как upsert, а после импорта удаляет или отвязывает компании
+	// области полной выгрузки (ImportOptions.Sync), которых не было в файле
+	ImportModeSync = "sync"
+)
+
+// ImportOptions - параметры одного импорта
+type ImportOptions struct {
+	// Mode - режим импорта, по умолчанию ImportModeInsert
+	Mode string
+
+	// Sync - область полной выгрузки, обязательна для ImportModeSync
+	Sync *SyncOptions
+
+	// Batch - сведения о файле для пометки добавленных строк (необязательно).
+	// Без него строки импорта не помечаются и не могут быть откачены
+	Batch *ImportBatch
+
+	// OnBatch вызывается с ID записи import_batch сразу после её создания (необязательно).
+	// При повторной попытке импорта запись создается заново с новым ID
+	OnBatch func(batchID int64)
+
+	// BeforeCommit выполняется в транзакции импорта перед коммитом (необязательно)
+	BeforeCommit func(tx *sql.Tx) error
+}
+
 // Insert вставляет данные в таблицу в определенном порядке
 // 1. Предзагрузка всех справочников батчем (region, district, city, category, subcategory)
 // 2. Отключаем проверку внешних ключей для ускорения вставки
 // 3. Батч-вставка geo записей (зависит от region, district, city)
 // 4. Батч-вставка компаний (независимая таблица)
-// 5. Обработка связей
-// 6. Массовая вставка связей (зависит от company, geo, category, subcategory)
+// 5. Обработка связей и контактов
+// 6. Массовая вставка связей и контактов (зависит от company, geo, category, subcategory)
 // 7. Включаем обратно проверку внешних ключей
 func (r *CompanyRepository) Insert(records []GisCompany) error {
 	if len(records) == 0 {
 		return nil
 	}
-	
-	// Повторные попытки при deadlock (до 5 раз)
-	maxRetries := 5
-	var lastErr error
-	
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			// Задержка перед повторной попыткой (экспоненциальная, минимум 500ms)
-			delay := time.Duration(attempt*attempt) * 500 * time.Millisecond
-			if delay < 500*time.Millisecond {
-				delay = 500 * time.Millisecond
-			}
-			time.Sleep(delay)
-			r.mu.Lock()
-			r.addError(fmt.Sprintf("Повторная попытка импорта (попытка %d/%d)", attempt+1, maxRetries))
-			r.mu.Unlock()
-		}
-		
-		err := r.insertWithRetry(records)
-		
-		if err == nil {
-			return nil
-		}
-		
-		lastErr = err
-		
-		// Проверяем, является ли ошибка deadlock
-		errStr := err.Error()
-		if strings.Contains(errStr, "Deadlock") || strings.Contains(errStr, "deadlock") || 
-		   strings.Contains(errStr, "Error 1213") {
-			// Продолжаем повторные попытки
-			continue
-		}
-		
-		// Для других ошибок не повторяем
-		return err
-	}
-	return fmt.Errorf("превышен лимит попыток при импорте: %w", lastErr)
+
+	return r.InsertStream(context.Background(), func(ctx context.Context, handle func(batch []GisCompany) error) error {
+		return handle(records)
+	}, ImportOptions{})
 }
 
-// insertWithRetry выполняет одну попытку вставки данных
-func (r *CompanyRepository) insertWithRetry(records []GisCompany) error {
-	// Случайная задержка перед началом транзакции (100-600ms) для уменьшения вероятности deadlock
-	// когда несколько воркеров одновременно обрабатывают похожие данные
-	// Обязательная задержка минимум 100ms + случайная до 500ms
-	randomDelay := 100*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond
-	time.Sleep(randomDelay)
-	
-	tx, err := r.db.Begin()
+// InsertStream импортирует записи, поступающие порциями из source, в одной транзакции.
+// Шаги 1-6 из Insert выполняются для каждой порции, поэтому в памяти одновременно
+// находится только текущая порция, а не весь файл.
+// При deadlock транзакция откатывается и ошибка возвращается вызывающему без ожидания:
+// повторная попытка с задержкой планируется через очереди RabbitMQ, а не внутри воркера.
+// При отмене ctx транзакция откатывается, а перед каждой порцией возвращается ctx.Err()
+func (r *CompanyRepository) InsertStream(ctx context.Context, source RecordSource, opts ImportOptions) error {
+	return r.insertWithRetry(ctx, source, opts)
+}
+
+// insertWithRetry выполняет одну попытку вставки данных.
+// Попытка, каждая порция, её этапы и запросы записываются в трассировку отдельными span'ами
+func (r *CompanyRepository) insertWithRetry(ctx context.Context, source RecordSource, opts ImportOptions) (err error) {
+	ctx, span := tracer.Start(ctx, "import.insert", trace.WithAttributes(attribute.String("import.mode", opts.Mode)))
+	defer func() {
+		// После отмены запросы завершаются ошибками драйвера или sql.ErrTxDone (транзакция уже откачена),
+		// поэтому добавляем к ошибке причину отмены, чтобы вызывающий мог её распознать
+		if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			err = fmt.Errorf("импорт прерван: %w: %w", ctx.Err(), err)
+		}
+		endSpan(span, err)
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("ошибка начала транзакции: %w", err)
 	}
 	
+	r.beginImport(opts)
+	r.ctx = ctx
+
 	// Используем флаг для отслеживания статуса транзакции
 	committed := false
 	defer func() {
@@ -129,128 +186,207 @@ func (r *CompanyRepository) insertWithRetry(records []GisCompany) error {
 					// Игнорируем ошибку, если транзакция уже закоммичена или откачена
 				}
 			}
+			// Связи неудачной попытки не должны попасть в следующую
+			r.resetLinks()
+			// Гео, вставленные в откаченной транзакции, больше не существуют
+			r.geoCache.Reset()
 		}
+		r.ctx = context.Background()
 	}()
 
-	// Предзагрузка справочников в отдельных коротких транзакциях (ДО основной транзакции)
-	// Это уменьшает время блокировки и вероятность deadlock
+	// Отключаем проверку внешних ключей для ускорения массовой вставки
+	if _, err := r.execSQL(tx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return fmt.Errorf("ошибка отключения FK: %w", err)
+	}
+
+	if opts.Batch != nil {
+		if err := r.createBatch(tx, opts.Batch); err != nil {
+			return err
+		}
+		if opts.OnBatch != nil {
+			opts.OnBatch(r.batchValue().(int64))
+		}
+	}
+
+	if err := source(ctx, func(batch []GisCompany) error {
+		// Прерываем импорт между порциями, если воркер останавливается
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return r.traceStep("import.batch", func() error {
+			return r.insertBatch(tx, batch)
+		}, attribute.Int("import.batch.records", len(batch)))
+	}); err != nil {
+		return err
+	}
+
+	// Компании области полной выгрузки, которых не было в файле
+	if r.mode == ImportModeSync {
+		if err := r.traceStep("import.sync_snapshot", func() error {
+			return r.syncSnapshot(tx, opts.Sync)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Измененные существующие компании помечаются импортом, чтобы откат не затронул чужие изменения
+	if opts.Batch != nil {
+		if err := r.traceStep("import.finish_batch", func() error {
+			return r.finishBatch(tx)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Включаем обратно проверку внешних ключей
+	if _, err := r.execSQL(tx, "SET FOREIGN_KEY_CHECKS = 1"); err != nil {
+		// Игнорируем ошибку при восстановлении FK проверки
+	}
+
+	if opts.BeforeCommit != nil {
+		if err := r.traceStep("import.before_commit", func() error {
+			return opts.BeforeCommit(tx)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := r.traceStep("import.commit", tx.Commit); err != nil {
+		return fmt.Errorf("ошибка коммита транзакции: %w", err)
+	}
+
+	// Помечаем транзакцию как закоммиченную, чтобы defer не пытался её откатить
+	committed = true
+	return nil
+}
+
+// insertBatch вставляет одну порцию записей в рамках транзакции импорта
+func (r *CompanyRepository) insertBatch(tx *sql.Tx, records []GisCompany) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	// Предзагрузка справочников выполняется для каждой порции в отдельных коротких транзакциях,
+	// пока транзакция импорта остается открытой. Новые значения справочников не ждут коммита всего файла,
+	// это уменьшает время блокировки и вероятность deadlock
 	// Справочники (region, district, city, category, subcategory) должны быть загружены
 	// до вставки зависимых таблиц (geo, company, связи)
-	if err := r.preloadDictionariesOutsideTx(records); err != nil {
+	if err := r.traceStep("import.preload_dictionaries", func() error {
+		return r.preloadDictionariesOutsideTx(records)
+	}); err != nil {
 		return fmt.Errorf("ошибка предзагрузки справочников: %w", err)
 	}
 
-	// Отключаем проверку внешних ключей для ускорения массовой вставки
-	if _, err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0"); err != nil {
-		return fmt.Errorf("ошибка отключения FK: %w", err)
-	}
-
 	// Батч-вставка geo (зависит от region, district, city, которые уже предзагружены)
-	if err := r.batchInsertGeo(tx, records); err != nil {
+	if err := r.traceStep("import.insert_geo", func() error {
+		return r.batchInsertGeo(tx, records)
+	}); err != nil {
 		return fmt.Errorf("ошибка батч-вставки geo: %w", err)
 	}
 
 	// Батч-вставка компаний
-	if err := r.batchInsertCompanies(tx, records); err != nil {
+	if err := r.traceStep("import.insert_companies", func() error {
+		return r.batchInsertCompanies(tx, records)
+	}); err != nil {
 		return fmt.Errorf("ошибка батч-вставки компаний: %w", err)
 	}
 
-	// Обработка связей
+	// Обработка связей и контактов
 	for _, record := range records {
-		geoID := r.getGeoID(record)
-		if geoID == 0 {
+		companyID, _ := r.company.Get(r.companyKey(record))
+
+		if companyID == 0 {
 			continue
 		}
 
-		categoryIDs, subcategoryIDs := r.getCategoryIDs(record)
+		r.mu.Lock()
+		r.seenCompanies[companyID] = true
+		r.mu.Unlock()
 
-		r.mu.RLock()
-		companyID := r.company[record.Name]
-		r.mu.RUnlock()
+		r.collectCompanyContacts(companyID, record.Phone, record.Email)
 
-		if companyID == 0 {
+		geoID := r.getGeoID(record)
+		if geoID == 0 {
 			continue
 		}
 
+		categoryIDs, subcategoryIDs := r.getCategoryIDs(record)
+
 		r.collectCompanyGeos(companyID, geoID)
 		r.collectCompanyCategories(companyID, categoryIDs, subcategoryIDs)
 	}
 
+	// В режимах upsert и sync сначала обновляем существующие компании и удаляем связи, которых нет в файле
+	if r.mode == ImportModeUpsert || r.mode == ImportModeSync {
+		if err := r.traceStep("import.upsert_companies", func() error {
+			return r.upsertCompanies(tx, records)
+		}); err != nil {
+			return fmt.Errorf("ошибка обновления компаний: %w", err)
+		}
+	}
+
 	// Массовая вставка связей
-	if err := r.insertCompanyGeos(tx); err != nil {
+	if err := r.traceStep("import.insert_company_geo", func() error {
+		return r.insertCompanyGeos(tx)
+	}); err != nil {
 		return fmt.Errorf("ошибка вставки связей company_geo: %w", err)
 	}
 
-	if err := r.insertCompanyCategories(tx); err != nil {
+	if err := r.traceStep("import.insert_company_categories", func() error {
+		return r.insertCompanyCategories(tx)
+	}); err != nil {
 		return fmt.Errorf("ошибка вставки связей company_categories: %w", err)
 	}
 
-	// Включаем обратно проверку внешних ключей
-	if _, err := tx.Exec("SET FOREIGN_KEY_CHECKS = 1"); err != nil {
-		// Игнорируем ошибку при восстановлении FK проверки
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("ошибка коммита транзакции: %w", err)
+	if err := r.traceStep("import.insert_company_contacts", func() error {
+		return r.insertCompanyContacts(tx)
+	}); err != nil {
+		return fmt.Errorf("ошибка вставки контактов company_contact: %w", err)
 	}
 
-	// Помечаем транзакцию как закоммиченную, чтобы defer не пытался её откатить
-	committed = true
+	// Связи порции уже вставлены, очищаем буферы, чтобы они не росли вместе с файлом
+	r.resetLinks()
+	r.trimCaches()
 	return nil
 }
 
-// GetSummary возвращает статистику импорта
+// GetSummary возвращает статистику текущего импорта.
+// Строки файла и отклоненные строки заполняет вызывающий по статистике парсера
 func (r *CompanyRepository) GetSummary() Summary {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	dictionaries := make(map[string]*EntryCount, len(r.dictionaries))
+	for table, count := range r.dictionaries {
+		copied := *count
+		dictionaries[table] = &copied
+	}
+	links := make(map[string]int, len(r.links))
+	for table, count := range r.links {
+		links[table] = count
+	}
+	changes, changesTruncated := r.companyChanges()
+
 	return Summary{
-		Company:      r.companyCount,
-		Category:     len(r.companyCategories),
-		Subcategory:  len(r.subcategory),
-		Region:       len(r.region),
-		District:     len(r.district),
-		City:         len(r.city),
-		Errors:       r.errors,
+		Companies: CompanyCount{
+			Inserted: len(r.createdCompanies),
+			Matched:  len(r.seenCompanies) - len(r.createdCompanies),
+		},
+		Dictionaries:     dictionaries,
+		Links:            links,
+		Updated:          len(r.changeOrder),
+		Changes:          changes,
+		ChangesTruncated: changesTruncated,
+		Removed:          r.removedCount,
+		Restored:         r.restoredCount,
+		ImportBatch:      r.batchID,
+		Errors:           append([]string(nil), r.errors...),
 	}
 }
 
 // preloadDictionaries предзагружает все справочники батчем
 func (r *CompanyRepository) preloadDictionaries(tx *sql.Tx, records []GisCompany) error {
-	uniqueValues := map[string]map[string]bool{
-		"region":      make(map[string]bool),
-		"district":    make(map[string]bool),
-		"city":        make(map[string]bool),
-		"category":    make(map[string]bool),
-		"subcategory": make(map[string]bool),
-	}
-
-	// Собираем уникальные значения из всех записей
-	for _, record := range records {
-		if record.Region != "" {
-			uniqueValues["region"][record.Region] = true
-		}
-		if record.District != "" {
-			uniqueValues["district"][record.District] = true
-		}
-		if record.City != "" {
-			uniqueValues["city"][record.City] = true
-		}
-
-		categories := r.extractCategories(record.Category)
-		for _, cat := range categories {
-			if cat != "" {
-				uniqueValues["category"][cat] = true
-			}
-		}
-
-		subcategories := r.extractCategories(record.Subcategory)
-		for _, subcat := range subcategories {
-			if subcat != "" {
-				uniqueValues["subcategory"][subcat] = true
-			}
-		}
-	}
+	uniqueValues := r.collectDictionaryValues(records)
 
 	// Батч-вставка для каждого справочника
 	tablesOrder := []string{"region", "district", "city", "category", "subcategory"}
@@ -261,7 +397,7 @@ func (r *CompanyRepository) preloadDictionaries(tx *sql.Tx, records []GisCompany
 			for name := range values {
 				names = append(names, name)
 			}
-			if err := r.batchInsertDictionary(tx, table, names); err != nil {
+			if _, err := r.batchInsertDictionary(tx, table, names); err != nil {
 				return fmt.Errorf("ошибка предзагрузки справочника %s: %w", table, err)
 			}
 		}
@@ -270,9 +406,8 @@ func (r *CompanyRepository) preloadDictionaries(tx *sql.Tx, records []GisCompany
 	return nil
 }
 
-// preloadDictionariesOutsideTx предзагружает справочники в отдельных транзакциях
-// Это уменьшает вероятность deadlock при одновременной обработке несколькими воркерами
-func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) error {
+// collectDictionaryValues собирает уникальные значения справочников порции: таблица -> значения
+func (r *CompanyRepository) collectDictionaryValues(records []GisCompany) map[string]map[string]bool {
 	uniqueValues := map[string]map[string]bool{
 		"region":      make(map[string]bool),
 		"district":    make(map[string]bool),
@@ -308,50 +443,42 @@ func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) e
 		}
 	}
 
+	return uniqueValues
+}
+
+// preloadDictionariesOutsideTx предзагружает справочники в отдельных транзакциях
+// Это уменьшает вероятность deadlock при одновременной обработке несколькими воркерами
+func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) error {
+	uniqueValues := r.collectDictionaryValues(records)
+
 	// Батч-вставка для каждого справочника в ОТДЕЛЬНОЙ транзакции
 	tablesOrder := []string{"region", "district", "city", "category", "subcategory"}
-	for i, table := range tablesOrder {
+	for _, table := range tablesOrder {
 		values := uniqueValues[table]
 		if len(values) == 0 {
 			continue
 		}
 
-		// Добавляем случайную задержку между справочниками
-		// для уменьшения одновременных обращений к БД разных воркеров
-		if i > 0 {
-			// Задержка 50-150ms между справочниками
-			interTableDelay := 50*time.Millisecond + time.Duration(rand.Intn(100))*time.Millisecond
-			time.Sleep(interTableDelay)
-		}
-
 		names := make([]string, 0, len(values))
 		for name := range values {
 			names = append(names, name)
 		}
 
-		// Каждый справочник предзагружается в отдельной короткой транзакции
+		// Каждый справочник предзагружается в отдельной короткой транзакции.
+		// Транзакция справочника маленькая, поэтому при deadlock повторяем её сразу, без ожидания
 		maxRetries := 3
 		var lastErr error
+		var inserted int64
 		
 		for attempt := 0; attempt < maxRetries; attempt++ {
-			if attempt > 0 {
-				// Экспоненциальная задержка между попытками (минимум 500ms)
-				// Увеличена для уменьшения конкуренции при большом количестве воркеров
-				delay := time.Duration(attempt*attempt) * 500 * time.Millisecond
-				if delay < 500*time.Millisecond {
-					delay = 500 * time.Millisecond
-				}
-				time.Sleep(delay)
-			}
-
 			// Создаем отдельную транзакцию для каждого справочника
-			tx, err := r.db.Begin()
+			tx, err := r.db.BeginTx(r.ctx, nil)
 			if err != nil {
 				lastErr = fmt.Errorf("ошибка начала транзакции для справочника %s: %w", table, err)
 				continue
 			}
 
-			err = r.batchInsertDictionary(tx, table, names)
+			inserted, err = r.batchInsertDictionary(tx, table, names)
 			if err == nil {
 				if err := tx.Commit(); err != nil {
 					tx.Rollback()
@@ -359,6 +486,7 @@ func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) e
 					continue
 				}
 				// Успешно
+				lastErr = nil
 				break
 			}
 
@@ -367,10 +495,9 @@ func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) e
 			lastErr = err
 
 			// Проверяем, является ли ошибка deadlock
-			errStr := err.Error()
-			if strings.Contains(errStr, "Deadlock") || strings.Contains(errStr, "deadlock") || 
-			   strings.Contains(errStr, "Error 1213") {
+			if isDeadlockError(err) {
 				if attempt < maxRetries-1 {
+					deadlockRetries.WithLabelValues("dictionary").Inc()
 					continue // Повторяем попытку
 				}
 			} else {
@@ -382,26 +509,26 @@ func (r *CompanyRepository) preloadDictionariesOutsideTx(records []GisCompany) e
 		if lastErr != nil {
 			return fmt.Errorf("ошибка предзагрузки справочника %s после %d попыток: %w", table, maxRetries, lastErr)
 		}
+
+		r.countDictionary(table, names, int(inserted))
 	}
 
 	return nil
 }
 
 // batchInsertDictionary батч-вставка справочника (только новые значения)
-func (r *CompanyRepository) batchInsertDictionary(tx *sql.Tx, table string, names []string) error {
+func (r *CompanyRepository) batchInsertDictionary(tx *sql.Tx, table string, names []string) (int64, error) {
 	if len(names) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	// Фильтруем уже загруженные значения для вставки
 	newNames := make([]string, 0)
 	namesToLoad := make([]string, 0) // Все имена, которые нужно загрузить в кэш
-	r.mu.RLock()
 	cache := r.getCacheForTable(table)
-	r.mu.RUnlock()
 
 	for _, name := range names {
-		if _, exists := cache[name]; !exists {
+		if _, exists := cache.Get(name); !exists {
 			// Если нет в кэше, нужно вставить и загрузить
 			newNames = append(newNames, name)
 			namesToLoad = append(namesToLoad, name)
@@ -413,6 +540,7 @@ func (r *CompanyRepository) batchInsertDictionary(tx *sql.Tx, table string, name
 	}
 
 	// Вставляем только новые значения батчем
+	var inserted int64
 	if len(newNames) > 0 {
 		// Используем INSERT IGNORE для избежания ошибок при одновременной вставке
 		placeholders := strings.Repeat("(?),", len(newNames))
@@ -424,15 +552,17 @@ func (r *CompanyRepository) batchInsertDictionary(tx *sql.Tx, table string, name
 			args[i] = name
 		}
 
-		if _, err := tx.Exec(query, args...); err != nil {
+		result, err := r.execSQL(tx, query, args...)
+		if err != nil {
 			r.addError(fmt.Sprintf("ошибка при вставке %s: %v", table, err))
-			return err
+			return 0, err
 		}
+		inserted, _ = result.RowsAffected()
 	}
 
 	// Загружаем ID для ВСЕХ используемых значений (не только новых)
 	// Это гарантирует, что все категории/подкатегории из текущего батча будут в кэше
-	return r.loadDictionaryFromDB(tx, table, namesToLoad)
+	return inserted, r.loadDictionaryFromDB(tx, table, namesToLoad)
 }
 
 // loadDictionaryFromDB загружает в кэш ID справочника из БД
@@ -462,37 +592,23 @@ func (r *CompanyRepository) loadDictionaryFromDB(tx *sql.Tx, table string, names
 			args[j] = name
 		}
 
-		rows, err := tx.Query(query, args...)
+		rows, err := r.querySQL(tx, query, args...)
 		if err != nil {
 			r.addError(fmt.Sprintf("ошибка при загрузке %s: %v", table, err))
 			return err
 		}
 
-		r.mu.Lock()
+		// Обновляем соответствующий кэш в зависимости от таблицы
+		cache := r.getCacheForTable(table)
 		for rows.Next() {
 			var id int
 			var name string
 			if err := rows.Scan(&id, &name); err != nil {
-				r.mu.Unlock()
 				rows.Close()
 				return err
 			}
-
-			// Обновляем соответствующий кэш в зависимости от таблицы
-			switch table {
-			case "region":
-				r.region[name] = id
-			case "district":
-				r.district[name] = id
-			case "city":
-				r.city[name] = id
-			case "category":
-				r.category[name] = id
-			case "subcategory":
-				r.subcategory[name] = id
-			}
+			cache.Set(name, id)
 		}
-		r.mu.Unlock()
 
 		if err := rows.Err(); err != nil {
 			rows.Close()
@@ -504,8 +620,8 @@ func (r *CompanyRepository) loadDictionaryFromDB(tx *sql.Tx, table string, names
 	return nil
 }
 
-// getCacheForTable возвращает соответствующий кэш (только для чтения)
-func (r *CompanyRepository) getCacheForTable(table string) map[string]int {
+// getCacheForTable возвращает соответствующий кэш
+func (r *CompanyRepository) getCacheForTable(table string) *lruCache {
 	switch table {
 	case "region":
 		return r.region
@@ -549,9 +665,12 @@ func (r *CompanyRepository) batchInsertGeo(tx *sql.Tx, records []GisCompany) err
 
 	// Конвертируем map в slice для батч-обработки
 	geoList := make([][3]*int, 0, len(geoData))
-	for _, geo := range geoData {
+	geoKeys := make([]string, 0, len(geoData))
+	for key, geo := range geoData {
 		geoList = append(geoList, geo)
+		geoKeys = append(geoKeys, key)
 	}
+	var inserted int64
 
 	// Разбиваем на батчи (максимум 10000 записей на батч, чтобы не превысить лимит MySQL 65535 параметров)
 	// 10000 * 3 = 30000 параметров - безопасный размер
@@ -573,11 +692,15 @@ func (r *CompanyRepository) batchInsertGeo(tx *sql.Tx, records []GisCompany) err
 			args = append(args, geo[0], geo[1], geo[2])
 		}
 
-		if _, err := tx.Exec(query, args...); err != nil {
+		result, err := r.execSQL(tx, query, args...)
+		if err != nil {
 			r.addError(fmt.Sprintf("ошибка при вставке geo: %v", err))
 			return err
 		}
+		affected, _ := result.RowsAffected()
+		inserted += affected
 	}
+	r.countDictionary("geo", geoKeys, int(inserted))
 
 	// Загружаем ID обратно в кэш батчами
 	return r.loadGeoFromDB(tx, geoList)
@@ -601,10 +724,14 @@ func (r *CompanyRepository) loadGeoFromDB(tx *sql.Tx, geoList [][3]*int) error {
 		) ENGINE=Memory
 	`, tempTableName)
 	
-	if _, err := tx.Exec(createTempTable); err != nil {
+	if _, err := r.execSQL(tx, createTempTable); err != nil {
 		return fmt.Errorf("ошибка создания временной таблицы: %w", err)
 	}
 
+	// Временная таблица живет до конца сессии, а при потоковом импорте
+	// создается на каждую порцию, поэтому удаляем её сразу после использования
+	defer r.execSQL(tx, fmt.Sprintf("DROP TEMPORARY TABLE IF EXISTS %s", tempTableName))
+
 	// Разбиваем на батчи для вставки в временную таблицу
 	const tempTableBatchSize = 5000
 	for i := 0; i < len(geoList); i += tempTableBatchSize {
@@ -624,7 +751,7 @@ func (r *CompanyRepository) loadGeoFromDB(tx *sql.Tx, geoList [][3]*int) error {
 			args = append(args, geo[0], geo[1], geo[2])
 		}
 
-		if _, err := tx.Exec(insertQuery, args...); err != nil {
+		if _, err := r.execSQL(tx, insertQuery, args...); err != nil {
 			return fmt.Errorf("ошибка вставки во временную таблицу: %w", err)
 		}
 	}
@@ -640,7 +767,7 @@ func (r *CompanyRepository) loadGeoFromDB(tx *sql.Tx, geoList [][3]*int) error {
 		)
 	`, tempTableName)
 
-	rows, err := tx.Query(query)
+	rows, err := r.querySQL(tx, query)
 	if err != nil {
 		return fmt.Errorf("ошибка при загрузке geo: %w", err)
 	}
@@ -660,7 +787,7 @@ func (r *CompanyRepository) loadGeoFromDB(tx *sql.Tx, geoList [][3]*int) error {
 			r.nullIntToPtr(districtID),
 			r.nullIntToPtr(cityID),
 		)
-		r.geoCache[key] = id
+		r.geoCache.Set(key, id)
 	}
 	
 	if err := rows.Err(); err != nil {
@@ -669,7 +796,6 @@ func (r *CompanyRepository) loadGeoFromDB(tx *sql.Tx, geoList [][3]*int) error {
 	}
 	r.mu.Unlock()
 
-	// Временная таблица автоматически удалится при завершении транзакции
 	return nil
 }
 
@@ -687,7 +813,8 @@ func (r *CompanyRepository) getGeoID(record GisCompany) int {
 	}
 
 	key := r.buildGeoKey(regionID, districtID, cityID)
-	return r.geoCache[key]
+	geoID, _ := r.geoCache.Get(key)
+	return geoID
 }
 
 // getCategoryIDs получает ID категорий и подкатегорий из кэша
@@ -701,7 +828,7 @@ func (r *CompanyRepository) getCategoryIDs(record GisCompany) ([]int, []int) {
 	categories := r.extractCategories(record.Category)
 	for _, category := range categories {
 		if category != "" {
-			if id, exists := r.category[category]; exists {
+			if id, exists := r.category.Get(category); exists {
 				categoryIDs = append(categoryIDs, id)
 			}
 		}
@@ -710,7 +837,7 @@ func (r *CompanyRepository) getCategoryIDs(record GisCompany) ([]int, []int) {
 	subcategories := r.extractCategories(record.Subcategory)
 	for _, subcategory := range subcategories {
 		if subcategory != "" {
-			if id, exists := r.subcategory[subcategory]; exists {
+			if id, exists := r.subcategory.Get(subcategory); exists {
 				subcategoryIDs = append(subcategoryIDs, id)
 			}
 		}
@@ -719,78 +846,261 @@ func (r *CompanyRepository) getCategoryIDs(record GisCompany) ([]int, []int) {
 	return categoryIDs, subcategoryIDs
 }
 
-// batchInsertCompanies батч-вставка компаний
+// batchInsertCompanies вставляет новые компании порции.
+// Компании с ID из выгрузки сопоставляются по external_id, поэтому одноименные компании
+// (например, филиалы сети) остаются разными записями. Компании без ID сопоставляются по названию
 func (r *CompanyRepository) batchInsertCompanies(tx *sql.Tx, records []GisCompany) error {
-	uniqueCompanies := make(map[string]bool)
+	byExternalID := make(map[string]string) // external_id -> название
+	byName := make(map[string]bool)
 
 	r.mu.RLock()
 	for _, record := range records {
-		if record.Name != "" {
-			if _, exists := r.company[record.Name]; !exists {
-				uniqueCompanies[record.Name] = true
-			}
+		if record.Name == "" {
+			continue
+		}
+		if _, exists := r.company.Get(r.companyKey(record)); exists {
+			continue
+		}
+		if record.ExternalID != "" {
+			byExternalID[record.ExternalID] = record.Name
+		} else {
+			byName[record.Name] = true
 		}
 	}
 	r.mu.RUnlock()
 
-	if len(uniqueCompanies) == 0 {
+	if err := r.insertCompaniesByExternalID(tx, byExternalID); err != nil {
+		return err
+	}
+	return r.insertCompaniesByName(tx, byName)
+}
+
+// insertCompaniesByExternalID вставляет компании с ID из выгрузки, которых еще нет в БД
+func (r *CompanyRepository) insertCompaniesByExternalID(tx *sql.Tx, companies map[string]string) error {
+	if len(companies) == 0 {
 		return nil
 	}
 
-	companyNames := make([]string, 0, len(uniqueCompanies))
-	for name := range uniqueCompanies {
-		companyNames = append(companyNames, name)
+	externalIDs := make([]string, 0, len(companies))
+	for externalID := range companies {
+		externalIDs = append(externalIDs, externalID)
+	}
+
+	if err := r.loadCompaniesByExternalID(tx, externalIDs); err != nil {
+		return err
+	}
+
+	// Компании, импортированные до появления external_id, получают ID из выгрузки
+	if err := r.claimCompaniesByName(tx, r.missingCompanies(externalIDs, "id:"), companies); err != nil {
+		return err
+	}
+
+	missing := r.missingCompanies(externalIDs, "id:")
+	if len(missing) == 0 {
+		return nil
 	}
 
-	placeholders := strings.Repeat("(?),", len(companyNames))
+	placeholders := strings.Repeat("(?, ?, ?),", len(missing))
 	placeholders = placeholders[:len(placeholders)-1]
-	query := fmt.Sprintf("INSERT IGNORE INTO csv.company (name) VALUES %s", placeholders)
+	query := fmt.Sprintf("INSERT IGNORE INTO csv.company (external_id, name, import_batch_id) VALUES %s", placeholders)
 
-	args := make([]interface{}, len(companyNames))
-	for i, name := range companyNames {
-		args[i] = name
+	batchID := r.batchValue()
+	args := make([]interface{}, 0, len(missing)*3)
+	for _, externalID := range missing {
+		args = append(args, externalID, companies[externalID], batchID)
 	}
 
-	if _, err := tx.Exec(query, args...); err != nil {
+	if _, err := r.execSQL(tx, query, args...); err != nil {
 		r.addError(fmt.Sprintf("ошибка при вставке компаний: %v", err))
 		return err
 	}
 
-	return r.loadCompaniesFromDB(tx, companyNames)
+	if err := r.loadCompaniesByExternalID(tx, missing); err != nil {
+		return err
+	}
+	r.markCreated("id:", missing)
+	return nil
 }
 
-// loadCompaniesFromDB загружает ID компаний из БД
-func (r *CompanyRepository) loadCompaniesFromDB(tx *sql.Tx, names []string) error {
-	if len(names) == 0 {
+// claimCompaniesByName присваивает external_id компаниям без ID с тем же названием
+func (r *CompanyRepository) claimCompaniesByName(tx *sql.Tx, externalIDs []string, companies map[string]string) error {
+	claims, err := r.findClaimableCompanies(tx, externalIDs, companies)
+	if err != nil {
+		return err
+	}
+	if len(claims) == 0 {
 		return nil
 	}
 
-	// Фильтруем уже загруженные
-	newNames := make([]string, 0)
-	r.mu.RLock()
-	for _, name := range names {
-		if name != "" {
-			if _, exists := r.company[name]; !exists {
-				newNames = append(newNames, name)
-			}
+	var cases []string
+	var caseArgs, idArgs []interface{}
+	claimed := make([]string, 0, len(claims))
+	for externalID, companyID := range claims {
+		cases = append(cases, "WHEN ? THEN ?")
+		caseArgs = append(caseArgs, companyID, externalID)
+		idArgs = append(idArgs, companyID)
+		claimed = append(claimed, externalID)
+	}
+
+	// Условие external_id IS NULL защищает от компании, которой ID уже присвоил другой воркер
+	query := fmt.Sprintf(
+		"UPDATE csv.company SET external_id = CASE id %s END WHERE external_id IS NULL AND id IN (%s)",
+		strings.Join(cases, " "), strings.TrimSuffix(strings.Repeat("?,", len(idArgs)), ","),
+	)
+	if _, err := r.execSQL(tx, query, append(caseArgs, idArgs...)...); err != nil {
+		r.addError(fmt.Sprintf("ошибка при обновлении компаний: %v", err))
+		return err
+	}
+
+	r.mu.Lock()
+	for _, companyID := range claims {
+		r.updatedCompanies[companyID] = true
+	}
+	r.mu.Unlock()
+
+	return r.loadCompaniesByExternalID(tx, claimed)
+}
+
+// findClaimableCompanies находит компании без ID, которым можно присвоить ID из выгрузки:
+// external_id -> ID компании. ID присваивается, только если в БД ровно одна компания с таким названием
+// и в порции ей соответствует ровно одна запись, иначе нельзя понять, какой из одноименных компаний она является
+func (r *CompanyRepository) findClaimableCompanies(tx *sql.Tx, externalIDs []string, companies map[string]string) (map[string]int, error) {
+	claims := make(map[string]int)
+	if len(externalIDs) == 0 {
+		return claims, nil
+	}
+
+	idsByName := make(map[string][]string)
+	for _, externalID := range externalIDs {
+		name := companies[externalID]
+		idsByName[name] = append(idsByName[name], externalID)
+	}
+
+	placeholders := strings.Repeat("?,", len(idsByName))
+	placeholders = placeholders[:len(placeholders)-1]
+	query := fmt.Sprintf("SELECT id, name FROM csv.company WHERE external_id IS NULL AND name IN (%s)", placeholders)
+
+	args := make([]interface{}, 0, len(idsByName))
+	for name := range idsByName {
+		args = append(args, name)
+	}
+
+	rows, err := r.querySQL(tx, query, args...)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке компаний: %v", err))
+		return nil, err
+	}
+
+	candidates := make(map[string][]int)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, err
 		}
+		candidates[name] = append(candidates[name], id)
 	}
-	r.mu.RUnlock()
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, ids := range idsByName {
+		if len(ids) == 1 && len(candidates[name]) == 1 {
+			claims[ids[0]] = candidates[name][0]
+		}
+	}
+
+	return claims, nil
+}
 
-	if len(newNames) == 0 {
+// insertCompaniesByName вставляет компании без ID из выгрузки, которых еще нет в БД
+func (r *CompanyRepository) insertCompaniesByName(tx *sql.Tx, companies map[string]bool) error {
+	if len(companies) == 0 {
 		return nil
 	}
 
-	placeholders := strings.Repeat("?,", len(newNames))
+	names := make([]string, 0, len(companies))
+	for name := range companies {
+		names = append(names, name)
+	}
+
+	if err := r.loadCompaniesByName(tx, names); err != nil {
+		return err
+	}
+
+	missing := r.missingCompanies(names, "name:")
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// Название компании без ID уникально (name_key): если другой импорт уже вставил такую компанию,
+	// вставка ждет его коммита и оставляет существующую строку, её ID загружается ниже
+	placeholders := strings.Repeat("(?, ?),", len(missing))
 	placeholders = placeholders[:len(placeholders)-1]
-	query := fmt.Sprintf("SELECT id, name FROM csv.company WHERE name IN (%s)", placeholders)
+	query := fmt.Sprintf("INSERT INTO csv.company (name, import_batch_id) VALUES %s ON DUPLICATE KEY UPDATE id = id", placeholders)
+
+	batchID := r.batchValue()
+	args := make([]interface{}, 0, len(missing)*2)
+	for _, name := range missing {
+		args = append(args, name, batchID)
+	}
+
+	if _, err := r.execSQL(tx, query, args...); err != nil {
+		r.addError(fmt.Sprintf("ошибка при вставке компаний: %v", err))
+		return err
+	}
 
-	args := make([]interface{}, len(newNames))
-	for i, name := range newNames {
+	if err := r.loadCompaniesByName(tx, missing); err != nil {
+		return err
+	}
+	r.markCreated("name:", missing)
+	return nil
+}
+
+// loadCompaniesByExternalID загружает ID компаний из БД по ID из выгрузки
+func (r *CompanyRepository) loadCompaniesByExternalID(tx *sql.Tx, externalIDs []string) error {
+	if len(externalIDs) == 0 {
+		return nil
+	}
+
+	placeholders := strings.Repeat("?,", len(externalIDs))
+	placeholders = placeholders[:len(placeholders)-1]
+	query := fmt.Sprintf("SELECT id, external_id FROM csv.company WHERE external_id IN (%s)", placeholders)
+
+	args := make([]interface{}, len(externalIDs))
+	for i, externalID := range externalIDs {
+		args[i] = externalID
+	}
+
+	return r.loadCompanies(tx, "id:", query, args)
+}
+
+// loadCompaniesByName загружает ID компаний без ID из выгрузки по названию.
+// Такое название уникально (name_key), но без учета регистра, поэтому сохраняется первая найденная компания
+func (r *CompanyRepository) loadCompaniesByName(tx *sql.Tx, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	placeholders := strings.Repeat("?,", len(names))
+	placeholders = placeholders[:len(placeholders)-1]
+	query := fmt.Sprintf("SELECT id, name FROM csv.company WHERE external_id IS NULL AND name IN (%s) ORDER BY id", placeholders)
+
+	args := make([]interface{}, len(names))
+	for i, name := range names {
 		args[i] = name
 	}
 
-	rows, err := tx.Query(query, args...)
+	return r.loadCompanies(tx, "name:", query, args)
+}
+
+// loadCompanies выполняет запрос (id, ключ) и добавляет компании в кэш с префиксом ключа.
+// Сравнение в MySQL не учитывает регистр, поэтому в кэш попадает точное значение из БД,
+// а для уже закэшированных ключей сохраняется первый ID
+func (r *CompanyRepository) loadCompanies(tx *sql.Tx, prefix string, query string, args []interface{}) error {
+	rows, err := r.querySQL(tx, query, args...)
 	if err != nil {
 		r.addError(fmt.Sprintf("ошибка при загрузке компаний: %v", err))
 		return err
@@ -798,21 +1108,41 @@ func (r *CompanyRepository) loadCompaniesFromDB(tx *sql.Tx, names []string) erro
 	defer rows.Close()
 
 	r.mu.Lock()
+	defer r.mu.Unlock()
 	for rows.Next() {
 		var id int
-		var name string
-		if err := rows.Scan(&id, &name); err != nil {
-			r.mu.Unlock()
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
 			return err
 		}
-		if _, exists := r.company[name]; !exists {
-			r.company[name] = id
-			r.companyCount++
+		if _, exists := r.company.Get(prefix + key); !exists {
+			r.company.Set(prefix+key, id)
 		}
 	}
-	r.mu.Unlock()
 
-	return nil
+	return rows.Err()
+}
+
+// missingCompanies возвращает значения, для которых в кэше нет компании
+func (r *CompanyRepository) missingCompanies(values []string, prefix string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	missing := make([]string, 0)
+	for _, value := range values {
+		if _, exists := r.company.Get(prefix + value); !exists {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// companyKey возвращает ключ компании в кэше: ID из выгрузки, если он есть, иначе название
+func (r *CompanyRepository) companyKey(record GisCompany) string {
+	if record.ExternalID != "" {
+		return "id:" + record.ExternalID
+	}
+	return "name:" + record.Name
 }
 
 // extractCategories выделяет категории/подкатегории из строки, разделенной запятой
@@ -911,6 +1241,54 @@ func (r *CompanyRepository) collectCompanyCategories(companyID int, categoryIDs
 	)
 }
 
+// extractContacts выделяет телефоны или email из строки, разделенной запятой
+func (r *CompanyRepository) extractContacts(commaValues string) []string {
+	if commaValues == "" {
+		return []string{}
+	}
+
+	values := strings.Split(commaValues, ",")
+	contacts := make([]string, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		// Пустые и не помещающиеся в колонку значения пропускаем
+		if v == "" || utf8.RuneCountInString(v) > contactMaxLength {
+			continue
+		}
+		contacts = append(contacts, v)
+	}
+
+	return contacts
+}
+
+// collectCompanyContacts привязывает к компании телефоны и email без повторов
+func (r *CompanyRepository) collectCompanyContacts(companyID int, phones string, emails string) {
+	phoneList := r.extractContacts(phones)
+	emailList := r.extractContacts(emails)
+	if len(phoneList) == 0 && len(emailList) == 0 {
+		return
+	}
+
+	// Email сравниваем без учета регистра
+	for i, email := range emailList {
+		emailList[i] = strings.ToLower(email)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.companyContacts[companyID] == nil {
+		r.companyContacts[companyID] = make(map[string][]string)
+	}
+
+	r.companyContacts[companyID]["phone"] = r.uniqueStrings(
+		append(r.companyContacts[companyID]["phone"], phoneList...),
+	)
+	r.companyContacts[companyID]["email"] = r.uniqueStrings(
+		append(r.companyContacts[companyID]["email"], emailList...),
+	)
+}
+
 // insertCompanyGeos вставляет батчами привязку компаний к гео
 func (r *CompanyRepository) insertCompanyGeos(tx *sql.Tx) error {
 	r.mu.RLock()
@@ -920,6 +1298,7 @@ func (r *CompanyRepository) insertCompanyGeos(tx *sql.Tx) error {
 	}
 
 	// Собираем все связи в плоский массив
+	batchID := r.batchValueLocked()
 	allLinks := make([][2]int, 0)
 	for companyID, geoIDs := range r.companyGeos {
 		for _, geoID := range geoIDs {
@@ -940,19 +1319,21 @@ func (r *CompanyRepository) insertCompanyGeos(tx *sql.Tx) error {
 		}
 		batch := allLinks[i:end]
 
-		placeholders := strings.Repeat("(?, ?),", len(batch))
+		placeholders := strings.Repeat("(?, ?, ?),", len(batch))
 		placeholders = placeholders[:len(placeholders)-1]
-		query := fmt.Sprintf("INSERT IGNORE INTO csv.company_geo (company_id, geo_id) VALUES %s", placeholders)
+		query := fmt.Sprintf("INSERT IGNORE INTO csv.company_geo (company_id, geo_id, import_batch_id) VALUES %s", placeholders)
 
-		args := make([]interface{}, 0, len(batch)*2)
+		args := make([]interface{}, 0, len(batch)*3)
 		for _, link := range batch {
-			args = append(args, link[0], link[1])
+			args = append(args, link[0], link[1], batchID)
 		}
 
-		if _, err := tx.Exec(query, args...); err != nil {
+		result, err := r.execSQL(tx, query, args...)
+		if err != nil {
 			r.addError(fmt.Sprintf("ошибка при вставке связей company_geo: %v", err))
 			return err
 		}
+		r.countLinks("company_geo", result)
 	}
 
 	return nil
@@ -968,6 +1349,7 @@ func (r *CompanyRepository) insertCompanyCategories(tx *sql.Tx) error {
 	r.mu.RUnlock()
 
 	fields := []string{"category", "subcategory"}
+	batchID := r.batchValue()
 
 	for _, fieldType := range fields {
 		r.mu.RLock()
@@ -993,33 +1375,162 @@ func (r *CompanyRepository) insertCompanyCategories(tx *sql.Tx) error {
 			}
 			batch := allLinks[i:end]
 
-			placeholders := strings.Repeat("(?, ?),", len(batch))
+			placeholders := strings.Repeat("(?, ?, ?),", len(batch))
 			placeholders = placeholders[:len(placeholders)-1]
-			query := fmt.Sprintf("INSERT IGNORE INTO csv.company_%s (company_id, %s_id) VALUES %s",
+			query := fmt.Sprintf("INSERT IGNORE INTO csv.company_%s (company_id, %s_id, import_batch_id) VALUES %s",
 				fieldType, fieldType, placeholders)
 
-			args := make([]interface{}, 0, len(batch)*2)
+			args := make([]interface{}, 0, len(batch)*3)
 			for _, link := range batch {
-				args = append(args, link[0], link[1])
+				args = append(args, link[0], link[1], batchID)
 			}
 
-			if _, err := tx.Exec(query, args...); err != nil {
+			result, err := r.execSQL(tx, query, args...)
+			if err != nil {
 				r.addError(fmt.Sprintf("ошибка при вставке связей company_%s: %v", fieldType, err))
 				return err
 			}
+			r.countLinks("company_"+fieldType, result)
 		}
 	}
 
 	return nil
 }
 
+// insertCompanyContacts вставляет батчами контакты компаний, которых еще нет в company_contact
+func (r *CompanyRepository) insertCompanyContacts(tx *sql.Tx) error {
+	r.mu.RLock()
+	if len(r.companyContacts) == 0 {
+		r.mu.RUnlock()
+		return nil
+	}
+
+	companyIDs := make([]int, 0, len(r.companyContacts))
+	for companyID := range r.companyContacts {
+		companyIDs = append(companyIDs, companyID)
+	}
+	r.mu.RUnlock()
+
+	// Контакты, уже сохраненные ранее, повторно не вставляем
+	existing, err := r.loadCompanyContactsFromDB(tx, companyIDs)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке контактов: %v", err))
+		return err
+	}
+
+	// Собираем новые контакты в плоский массив: company_id, phone, email
+	allContacts := make([][3]interface{}, 0)
+	r.mu.RLock()
+	for companyID, types := range r.companyContacts {
+		for _, phone := range types["phone"] {
+			if !existing[r.contactKey(companyID, "phone", phone)] {
+				allContacts = append(allContacts, [3]interface{}{companyID, phone, nil})
+			}
+		}
+		for _, email := range types["email"] {
+			if !existing[r.contactKey(companyID, "email", email)] {
+				allContacts = append(allContacts, [3]interface{}{companyID, nil, email})
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(allContacts) == 0 {
+		return nil
+	}
+
+	batchID := r.batchValue()
+
+	// Разбиваем на батчи
+	for i := 0; i < len(allContacts); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(allContacts) {
+			end = len(allContacts)
+		}
+		batch := allContacts[i:end]
+
+		placeholders := strings.Repeat("(?, ?, ?, ?),", len(batch))
+		placeholders = placeholders[:len(placeholders)-1]
+		query := fmt.Sprintf("INSERT INTO csv.company_contact (company_id, phone, email, import_batch_id) VALUES %s", placeholders)
+
+		args := make([]interface{}, 0, len(batch)*4)
+		for _, contact := range batch {
+			args = append(args, contact[0], contact[1], contact[2], batchID)
+		}
+
+		result, err := r.execSQL(tx, query, args...)
+		if err != nil {
+			r.addError(fmt.Sprintf("ошибка при вставке контактов: %v", err))
+			return err
+		}
+		r.countLinks("company_contact", result)
+	}
+
+	return nil
+}
+
+// loadCompanyContactsFromDB загружает уже сохраненные контакты компаний
+// Возвращает множество ключей contactKey
+func (r *CompanyRepository) loadCompanyContactsFromDB(tx *sql.Tx, companyIDs []int) (map[string]bool, error) {
+	existing := make(map[string]bool)
+
+	for i := 0; i < len(companyIDs); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(companyIDs) {
+			end = len(companyIDs)
+		}
+		batch := companyIDs[i:end]
+
+		placeholders := strings.Repeat("?,", len(batch))
+		placeholders = placeholders[:len(placeholders)-1]
+		query := fmt.Sprintf("SELECT company_id, phone, email FROM csv.company_contact WHERE company_id IN (%s)", placeholders)
+
+		args := make([]interface{}, len(batch))
+		for j, companyID := range batch {
+			args[j] = companyID
+		}
+
+		rows, err := r.querySQL(tx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var companyID int
+			var phone, email sql.NullString
+			if err := rows.Scan(&companyID, &phone, &email); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if phone.Valid {
+				existing[r.contactKey(companyID, "phone", phone.String)] = true
+			}
+			if email.Valid {
+				existing[r.contactKey(companyID, "email", strings.ToLower(email.String))] = true
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+	}
+
+	return existing, nil
+}
+
 // Вспомогательные методы
 
-func (r *CompanyRepository) getIDFromCache(cache map[string]int, key string) *int {
+func (r *CompanyRepository) contactKey(companyID int, contactType string, value string) string {
+	return fmt.Sprintf("%d:%s:%s", companyID, contactType, value)
+}
+
+func (r *CompanyRepository) getIDFromCache(cache *lruCache, key string) *int {
 	if key == "" {
 		return nil
 	}
-	if id, exists := cache[key]; exists {
+	if id, exists := cache.Get(key); exists {
 		return &id
 	}
 	return nil
@@ -1061,6 +1572,117 @@ func (r *CompanyRepository) uniqueInts(ints []int) []int {
 	return result
 }
 
+// beginImport сбрасывает состояние импорта перед новой попыткой
+func (r *CompanyRepository) beginImport(opts ImportOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.mode = opts.Mode
+	if r.mode == "" {
+		r.mode = ImportModeInsert
+	}
+	r.createdCompanies = make(map[int]bool)
+	r.replacedContacts = make(map[int]bool)
+	r.replacedLinks = make(map[int]bool)
+	r.changes = make(map[int]*CompanyChange)
+	r.changeOrder = nil
+	r.seenCompanies = make(map[int]bool)
+	r.updatedCompanies = make(map[int]bool)
+	r.removedCount = 0
+	r.restoredCount = 0
+	r.batchID = 0
+	r.dictionarySeen = make(map[string]map[string]bool)
+	r.dictionaries = make(map[string]*EntryCount)
+	for _, table := range dictionaryTables {
+		r.dictionarySeen[table] = make(map[string]bool)
+		r.dictionaries[table] = &EntryCount{}
+	}
+	r.links = make(map[string]int)
+	for _, table := range linkTables {
+		r.links[table] = 0
+	}
+	r.errors = nil
+
+	// Компании могли быть удалены откатом другого импорта, поэтому их ID не переиспользуются
+	// между импортами, а загружаются из БД заново
+	r.company.Reset()
+
+	// Буферы связей принадлежат одному импорту
+	r.companyGeos = make(map[int][]int)
+	r.companyCategories = make(map[int]map[string][]int)
+	r.companyContacts = make(map[int]map[string][]string)
+}
+
+// markCreated отмечает компании, вставленные текущим импортом
+func (r *CompanyRepository) markCreated(prefix string, values []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, value := range values {
+		if id, exists := r.company.Get(prefix + value); exists {
+			r.createdCompanies[id] = true
+		}
+	}
+}
+
+// resetLinks очищает буферы связей после их вставки
+func (r *CompanyRepository) resetLinks() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.companyGeos = make(map[int][]int)
+	r.companyCategories = make(map[int]map[string][]int)
+	r.companyContacts = make(map[int]map[string][]string)
+}
+
+// trimCaches вытесняет из кэшей давно не использованные записи сверх ограничения.
+// Вызывается между порциями, когда значения текущей порции уже не нужны
+func (r *CompanyRepository) trimCaches() {
+	for _, cache := range []*lruCache{r.region, r.district, r.city, r.category, r.subcategory, r.company, r.geoCache} {
+		cache.Trim()
+	}
+}
+
+func (r *CompanyRepository) uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// countDictionary учитывает в статистике значения справочника порции: inserted из них вставлены,
+// остальные, еще не учтенные в этом импорте, уже были в БД
+func (r *CompanyRepository) countDictionary(table string, values []string, inserted int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unseen := 0
+	for _, value := range values {
+		if !r.dictionarySeen[table][value] {
+			r.dictionarySeen[table][value] = true
+			unseen++
+		}
+	}
+
+	r.dictionaries[table].New += inserted
+	if existing := unseen - inserted; existing > 0 {
+		r.dictionaries[table].Existing += existing
+	}
+}
+
+// countLinks учитывает в статистике строки, вставленные в таблицу связей
+func (r *CompanyRepository) countLinks(table string, result sql.Result) {
+	affected, _ := result.RowsAffected()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.links[table] += int(affected)
+}
+
 func (r *CompanyRepository) addError(err string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCollectCompanyContacts(t *testing.T) {
+	r := NewCompanyRepository(nil, 0)
+
+	r.collectCompanyContacts(1, "+7 (383) 218-33-85, , +7 (383) 218-33-85", "Info@Example.ru,info@example.ru")
+	// Повторная строка той же компании дополняет контакты без повторов
+	r.collectCompanyContacts(1, "+7 (383) 218-33-86", "sales@example.ru, "+strings.Repeat("a", contactMaxLength)+"@example.ru")
+	// Компания без контактов не попадает в буфер
+	r.collectCompanyContacts(2, "", " , ")
+
+	phones := strings.Join(r.companyContacts[1]["phone"], ",")
+	if phones != "+7 (383) 218-33-85,+7 (383) 218-33-86" {
+		t.Errorf("телефоны: получено %q", phones)
+	}
+	emails := strings.Join(r.companyContacts[1]["email"], ",")
+	if emails != "info@example.ru,sales@example.ru" {
+		t.Errorf("email: получено %q", emails)
+	}
+	if _, ok := r.companyContacts[2]; ok {
+		t.Errorf("контакты компании без телефонов и email: %v", r.companyContacts[2])
+	}
+}
+
+func TestInsertStreamCancelledMidBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Запрос порции выполняется дольше, чем воркер ждет остановки
+	mock.ExpectBegin()
+	mock.ExpectExec("SET FOREIGN_KEY_CHECKS = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id, name FROM csv.company").
+		WillDelayFor(5 * time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	mock.ExpectRollback()
+
+	importCtx, cancelImport := context.WithCancel(context.Background())
+	source := func(ctx context.Context, handle func(batch []GisCompany) error) error {
+		time.AfterFunc(50*time.Millisecond, cancelImport)
+		return handle([]GisCompany{{Name: "Компания"}})
+	}
+
+	started := time.Now()
+	err = NewCompanyRepository(db, 0).InsertStream(importCtx, source, ImportOptions{})
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("запрос не прерван отменой контекста: импорт занял %s", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ожидалась ошибка отмены, получено: %v", err)
+	}
+
+	// Прерванная задача возвращается в очередь, а не уходит в повторные попытки или dead-letter
+	w := &Worker{importCtx: importCtx}
+	if !w.interrupted(err) {
+		t.Error("импорт, прерванный остановкой, не распознан")
+	}
+	if !w.interrupted(sql.ErrTxDone) {
+		t.Error("ошибка завершенной транзакции после остановки не распознана")
+	}
+	if (&Worker{importCtx: context.Background()}).interrupted(sql.ErrTxDone) {
+		t.Error("ошибка без остановки воркера не должна считаться прерыванием")
+	}
+}
+
+func TestInsertStreamReportsBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET FOREIGN_KEY_CHECKS = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO csv.import_batch").
+		WithArgs(int64(42), "companies.csv", nil).
+		WillReturnResult(sqlmock.NewResult(17, 1))
+	mock.ExpectRollback()
+
+	// ID импорта известен до чтения файла, чтобы попасть во все записи лога задачи
+	var reported int64
+	source := func(ctx context.Context, handle func(batch []GisCompany) error) error {
+		if reported != 17 {
+			t.Errorf("ID импорта до чтения файла: ожидался 17, получен %d", reported)
+		}
+		return errors.New("файл поврежден")
+	}
+	err = NewCompanyRepository(db, 0).InsertStream(context.Background(), source, ImportOptions{
+		Batch:   &ImportBatch{JobID: 42, FileName: "companies.csv"},
+		OnBatch: func(batchID int64) { reported = batchID },
+	})
+	if err == nil {
+		t.Fatal("ожидалась ошибка чтения файла")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSummaryChangesLimit(t *testing.T) {
+	r := NewCompanyRepository(nil, 0)
+	r.beginImport(ImportOptions{Mode: ImportModeUpsert})
+	for companyID := 1; companyID <= upsertMaxChanges+5; companyID++ {
+		r.change(companyID, GisCompany{Name: "Компания"})
+	}
+
+	summary := r.GetSummary()
+	if summary.Updated != upsertMaxChanges+5 {
+		t.Errorf("обновлено компаний: ожидалось %d, получено %d", upsertMaxChanges+5, summary.Updated)
+	}
+	if len(summary.Changes) != upsertMaxChanges || summary.ChangesTruncated != 5 {
+		t.Errorf("ожидалось %d изменений и 5 не вошедших в список, получено %d и %d",
+			upsertMaxChanges, len(summary.Changes), summary.ChangesTruncated)
+	}
+	if summary.Changes[0].CompanyID != 1 {
+		t.Errorf("изменения должны идти в порядке обнаружения, первое: %d", summary.Changes[0].CompanyID)
+	}
+}
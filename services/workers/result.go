@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ImportResult - событие о завершении импорта. Публикуется в exchange результатов
+// с ключом маршрутизации, равным статусу: done, failed или skipped
+type ImportResult struct {
+	JobID     int64  `json:"job_id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Status    string `json:"status"`
+	Queue     string `json:"queue"`
+	WorkerID  string `json:"worker_id"`
+	// Attempt - номер попытки обработки задачи, начиная с 1
+	Attempt int `json:"attempt"`
+
+	// Task - исходная задача (нет, если сообщение не удалось декодировать)
+	Task *ImportTask `json:"task,omitempty"`
+
+	// Summary - статистика импорта (Summary) или отчет проверки (DryRunReport)
+	Summary interface{} `json:"summary,omitempty"`
+
+	// DuplicateOf - задача, в которой файл уже был импортирован (статус skipped)
+	DuplicateOf int64 `json:"duplicate_of,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// StartedAt и FinishedAt - начало и конец последней попытки
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// declareResultExchange объявляет topic exchange для событий о завершении импорта.
+// Очереди к нему привязывают сервисы, которым нужны результаты
+func declareResultExchange(ch *amqp.Channel, exchange string) error {
+	if exchange == "" {
+		return nil
+	}
+
+	if err := ch.ExchangeDeclare(
+		exchange, // name
+		"topic",  // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	); err != nil {
+		return fmt.Errorf("ошибка объявления exchange результатов: %w", err)
+	}
+	return nil
+}
+
+// publishResult публикует событие о завершении импорта в exchange результатов и,
+// если в сообщении задан reply_to, в очередь ответа. correlation_id берется из сообщения
+// (или его MessageId), чтобы отправитель мог сопоставить ответ с задачей.
+// Если в задаче указан callback_url, то же событие отправляется на него POST-запросом.
+// Ошибка публикации только логируется: импорт уже завершен и сообщение будет подтверждено.
+// Перед публикацией задача учитывается в метриках
+func (w *Worker) publishResult(d amqp.Delivery, result *ImportResult, logger *slog.Logger) {
+	result.FinishedAt = time.Now()
+	result.DurationMs = result.FinishedAt.Sub(result.StartedAt).Milliseconds()
+	observeImport(w.queueName, result)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("Ошибка сериализации результата импорта", "error", err)
+		return
+	}
+
+	correlationID := d.CorrelationId
+	if correlationID == "" {
+		correlationID = d.MessageId
+	}
+
+	msg := amqp.Publishing{
+		Body:          body,
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: correlationID,
+		Type:          result.Status,
+		Timestamp:     result.FinishedAt,
+	}
+
+	ch := w.currentChannel()
+	if w.resultExchange != "" {
+		if err := ch.Publish(w.resultExchange, result.Status, false, false, msg); err != nil {
+			logger.Error("Ошибка публикации результата импорта", "error", err)
+		}
+	}
+
+	if d.ReplyTo != "" {
+		if err := ch.Publish("", d.ReplyTo, false, false, msg); err != nil {
+			logger.Error("Ошибка публикации ответа", "reply_to", d.ReplyTo, "error", err)
+		}
+	}
+
+	if result.Task != nil && result.Task.CallbackURL != "" {
+		w.webhooks.Notify(result.Task.CallbackURL, result.Status, body, logger)
+	}
+}
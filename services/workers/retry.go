@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// retryJitter - доля задержки, на которую она может быть случайно уменьшена
+const retryJitter = 0.25
+
+// RetryPolicy описывает отложенные повторные попытки через очереди RabbitMQ.
+// Для каждого уровня задержки объявляется очередь <queue>.retry.<N>s с TTL,
+// из которой просроченные сообщения возвращаются в рабочую очередь через dead-lettering
+type RetryPolicy struct {
+	MaxRetries int
+	Delays     []time.Duration
+}
+
+// NewRetryPolicy строит уровни экспоненциальной задержки: base, 2*base, 4*base... до max
+func NewRetryPolicy(maxRetries int, base time.Duration, max time.Duration) RetryPolicy {
+	if base <= 0 {
+		base = time.Second
+	}
+	if max < base {
+		max = base
+	}
+
+	var delays []time.Duration
+	for delay := base; ; delay *= 2 {
+		if delay >= max {
+			delays = append(delays, max)
+			break
+		}
+		delays = append(delays, delay)
+	}
+
+	return RetryPolicy{
+		MaxRetries: maxRetries,
+		Delays:     delays,
+	}
+}
+
+// Delay возвращает уровень задержки для попытки attempt (начиная с 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	level := attempt - 1
+	if level < 0 {
+		level = 0
+	}
+	if level >= len(p.Delays) {
+		level = len(p.Delays) - 1
+	}
+	return p.Delays[level]
+}
+
+// Jitter возвращает случайную задержку в диапазоне [delay*(1-retryJitter), delay].
+// Задержка только уменьшается, чтобы не превысить TTL очереди уровня
+func (p RetryPolicy) Jitter(delay time.Duration) time.Duration {
+	return delay - time.Duration(rand.Float64()*retryJitter*float64(delay))
+}
+
+// retryQueueName возвращает имя очереди задержки для рабочей очереди
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%ds", queueName, int(delay/time.Second))
+}
+
+// declareRetryQueues объявляет очереди задержки для всех уровней политики
+func declareRetryQueues(ch *amqp.Channel, queueName string, policy RetryPolicy) error {
+	for _, delay := range policy.Delays {
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		}
+
+		if _, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay), // name
+			true,                             // durable
+			false,                            // delete when unused
+			false,                            // exclusive
+			false,                            // no-wait
+			args,                             // arguments
+		); err != nil {
+			return fmt.Errorf("ошибка объявления очереди повторных попыток: %w", err)
+		}
+	}
+	return nil
+}
+
+// scheduleRetry публикует сообщение в очередь задержки для попытки attempt.
+// Сообщение вернется в рабочую очередь по истечении задержки, а воркер тем временем
+// продолжает обрабатывать другие сообщения
+func (w *Worker) scheduleRetry(d amqp.Delivery, attempt int, jobID int64) error {
+	// Обновляем заголовки с новым счетчиком попыток
+	headers := jobHeaders(d.Headers, jobID)
+	headers["x-retry-count"] = attempt
+
+	delay := w.retryPolicy.Delay(attempt)
+	expiration := w.retryPolicy.Jitter(delay)
+
+	if err := w.republish(d, retryQueueName(w.queueName, delay), headers, strconv.FormatInt(expiration.Milliseconds(), 10)); err != nil {
+		return fmt.Errorf("ошибка публикации в очередь повторных попыток: %w", err)
+	}
+	return nil
+}
+
+// requeue возвращает сообщение в конец рабочей очереди без увеличения счетчика попыток.
+// В отличие от nack с requeue, сообщение перепубликуется с ID задачи в заголовке x-import-job-id,
+// чтобы повторная обработка продолжила ту же запись import_job. Если перепубликация не удалась,
+// сообщение возвращается в очередь через nack
+func (w *Worker) requeue(d amqp.Delivery, jobID int64, logger *slog.Logger) {
+	if jobID == 0 || getJobID(d.Headers) == jobID {
+		w.nack(d, true, logger)
+		return
+	}
+
+	if err := w.republish(d, w.queueName, jobHeaders(d.Headers, jobID), ""); err != nil {
+		logger.Error("Ошибка возврата задачи в очередь", "error", err)
+		w.nack(d, true, logger)
+		return
+	}
+	w.ack(d, logger)
+}
+
+// jobHeaders возвращает копию заголовков сообщения с ID задачи импорта
+func jobHeaders(source amqp.Table, jobID int64) amqp.Table {
+	headers := make(amqp.Table, len(source)+1)
+	for k, v := range source {
+		headers[k] = v
+	}
+	if jobID > 0 {
+		headers["x-import-job-id"] = jobID
+	}
+	return headers
+}
+
+// republish публикует копию сообщения с новыми заголовками в очередь routingKey
+func (w *Worker) republish(d amqp.Delivery, routingKey string, headers amqp.Table, expiration string) error {
+	return w.currentChannel().Publish(
+		"",         // exchange (default exchange для прямой публикации в очередь)
+		routingKey, // routing key (имя очереди)
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			Body:         d.Body,
+			Headers:      headers,
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent, // 2 - persistent
+			Priority:     d.Priority,
+			MessageId:    d.MessageId,
+			// Получатель результата задан в исходном сообщении и должен сохраниться между попытками
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Timestamp:     time.Now(),
+			Expiration:    expiration,
+		},
+	)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryPolicyDelays(t *testing.T) {
+	policy := NewRetryPolicy(10, time.Second, 60*time.Second)
+
+	expected := []time.Duration{1, 2, 4, 8, 16, 32, 60}
+	if len(policy.Delays) != len(expected) {
+		t.Fatalf("ожидалось %d уровней, получено %v", len(expected), policy.Delays)
+	}
+	for i, delay := range expected {
+		if policy.Delays[i] != delay*time.Second {
+			t.Errorf("уровень %d: ожидалось %v, получено %v", i, delay*time.Second, policy.Delays[i])
+		}
+	}
+
+	if policy.Delay(1) != time.Second || policy.Delay(3) != 4*time.Second || policy.Delay(10) != 60*time.Second {
+		t.Errorf("неверный выбор уровня задержки: %v %v %v", policy.Delay(1), policy.Delay(3), policy.Delay(10))
+	}
+
+	for i := 0; i < 100; i++ {
+		jittered := policy.Jitter(8 * time.Second)
+		if jittered > 8*time.Second || jittered < 6*time.Second {
+			t.Fatalf("задержка с jitter вне диапазона: %v", jittered)
+		}
+	}
+
+	if name := retryQueueName("csv_import_normal", 4*time.Second); name != "csv_import_normal.retry.4s" {
+		t.Errorf("неверное имя очереди задержки: %s", name)
+	}
+}
+
+func TestJobHeaders(t *testing.T) {
+	source := amqp.Table{"x-retry-count": 2, "traceparent": "00-trace"}
+
+	headers := jobHeaders(source, 42)
+	if getJobID(headers) != 42 || getRetryCount(headers) != 2 || headers["traceparent"] != "00-trace" {
+		t.Errorf("неверные заголовки: %v", headers)
+	}
+	// Заголовки исходного сообщения не меняются
+	if _, ok := source["x-import-job-id"]; ok {
+		t.Errorf("изменены заголовки исходного сообщения: %v", source)
+	}
+
+	if _, ok := jobHeaders(source, 0)["x-import-job-id"]; ok {
+		t.Error("заголовок x-import-job-id не должен добавляться для неотслеживаемой задачи")
+	}
+}
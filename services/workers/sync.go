@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Действия с компаниями, которых нет в полной выгрузке
+const (
+	// SyncActionDelete помечает компанию удаленной (company.deleted_at)
+	SyncActionDelete = "delete"
+	// SyncActionUnlink удаляет связи компании с областью выгрузки: с рубриками области,
+	// а если рубрики не заданы - с гео регионов области
+	SyncActionUnlink = "unlink"
+)
+
+// SyncOptions описывает область полной выгрузки для режима sync.
+// Компании области, которых нет в файле, после импорта удаляются или отвязываются
+//
+// Пример:
+//
+//	{
+//	  "regions": ["Новосибирская область"],
+//	  "categories": ["Общественное питание"],
+//	  "action": "delete",
+//	  "max_remove_percent": 20
+//	}
+type SyncOptions struct {
+	// Regions - регионы выгрузки
+	Regions []string `json:"regions,omitempty"`
+	// Categories - рубрики выгрузки
+	Categories []string `json:"categories,omitempty"`
+	// Action - delete (по умолчанию) или unlink
+	Action string `json:"action,omitempty"`
+	// MaxRemovePercent - максимальная доля удаляемых компаний области в процентах.
+	// Если удалить нужно больше, импорт отменяется. 0 запрещает удаление,
+	// если порог не указан - используется значение из настроек воркера
+	MaxRemovePercent *int `json:"max_remove_percent,omitempty"`
+}
+
+// ApplyDefaults подставляет порог из настроек воркера, если он не указан в задаче
+func (o *SyncOptions) ApplyDefaults(maxRemovePercent int) {
+	if o.MaxRemovePercent == nil {
+		o.MaxRemovePercent = &maxRemovePercent
+	}
+}
+
+// removeLimit возвращает порог удаления. Без порога ничего не удаляется
+func (o *SyncOptions) removeLimit() int {
+	if o.MaxRemovePercent == nil {
+		return 0
+	}
+	return *o.MaxRemovePercent
+}
+
+// Validate проверяет, что область выгрузки задана, а действие и порог корректны
+func (o *SyncOptions) Validate() error {
+	if len(o.Regions) == 0 && len(o.Categories) == 0 {
+		return fmt.Errorf("для режима sync нужно указать регионы или рубрики выгрузки")
+	}
+
+	switch o.Action {
+	case "", SyncActionDelete, SyncActionUnlink:
+	default:
+		return fmt.Errorf("неизвестное действие синхронизации: %s", o.Action)
+	}
+
+	if limit := o.removeLimit(); limit < 0 || limit > 100 {
+		return fmt.Errorf("порог синхронизации должен быть от 0 до 100%%: %d", limit)
+	}
+	return nil
+}
+
+// syncSnapshot удаляет или отвязывает компании области выгрузки, которых не было в файле.
+// Выполняется в транзакции импорта после всех порций, поэтому при превышении порога
+// откатывается весь импорт
+func (r *CompanyRepository) syncSnapshot(tx *sql.Tx, opts *SyncOptions) error {
+	scoped, err := r.loadScopedCompanies(tx, opts)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке компаний области выгрузки: %v", err))
+		return err
+	}
+
+	r.mu.RLock()
+	missing := missingFromSnapshot(scoped, r.seenCompanies)
+	r.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := checkRemoveLimit(len(missing), len(scoped), opts.removeLimit()); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(missing); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		if err := r.removeMissingCompanies(tx, opts, missing[i:end]); err != nil {
+			r.addError(fmt.Sprintf("ошибка при удалении компаний, отсутствующих в выгрузке: %v", err))
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.removedCount = len(missing)
+	for _, companyID := range missing {
+		r.updatedCompanies[companyID] = true
+	}
+	r.mu.Unlock()
+
+	return nil
+}
+
+// missingFromSnapshot возвращает компании области выгрузки, которых не было в файле
+func missingFromSnapshot(scoped []int, seen map[int]bool) []int {
+	missing := make([]int, 0)
+	for _, companyID := range scoped {
+		if !seen[companyID] {
+			missing = append(missing, companyID)
+		}
+	}
+	return missing
+}
+
+// checkRemoveLimit возвращает ошибку, если удалить нужно больше maxRemovePercent процентов компаний области
+func checkRemoveLimit(missing int, scoped int, maxRemovePercent int) error {
+	if missing*100 > scoped*maxRemovePercent {
+		return fmt.Errorf("синхронизация остановлена: в файле нет %d из %d компаний области выгрузки (%.1f%%), допустимо не более %d%%",
+			missing, scoped, float64(missing)*100/float64(scoped), maxRemovePercent)
+	}
+	return nil
+}
+
+// loadScopedCompanies возвращает ID неудаленных компаний, привязанных к регионам и рубрикам области
+func (r *CompanyRepository) loadScopedCompanies(tx *sql.Tx, opts *SyncOptions) ([]int, error) {
+	var joins, conditions []string
+	var args []interface{}
+
+	if len(opts.Regions) > 0 {
+		joins = append(joins,
+			"JOIN csv.company_geo cg ON cg.company_id = c.id",
+			"JOIN csv.geo g ON g.id = cg.geo_id",
+			"JOIN csv.region rg ON rg.id = g.region_id")
+		conditions = append(conditions, fmt.Sprintf("rg.name IN (%s)", placeholderList(len(opts.Regions))))
+		for _, region := range opts.Regions {
+			args = append(args, region)
+		}
+	}
+
+	if len(opts.Categories) > 0 {
+		joins = append(joins,
+			"JOIN csv.company_category cc ON cc.company_id = c.id",
+			"JOIN csv.category cat ON cat.id = cc.category_id")
+		conditions = append(conditions, fmt.Sprintf("cat.name IN (%s)", placeholderList(len(opts.Categories))))
+		for _, category := range opts.Categories {
+			args = append(args, category)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT DISTINCT c.id FROM csv.company c %s WHERE c.deleted_at IS NULL AND %s",
+		strings.Join(joins, " "), strings.Join(conditions, " AND "))
+
+	rows, err := r.querySQL(tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// removeMissingCompanies выполняет действие синхронизации для порции компаний
+func (r *CompanyRepository) removeMissingCompanies(tx *sql.Tx, opts *SyncOptions, companyIDs []int) error {
+	args := make([]interface{}, len(companyIDs))
+	for i, companyID := range companyIDs {
+		args[i] = companyID
+	}
+	idList := placeholderList(len(companyIDs))
+
+	if opts.Action != SyncActionUnlink {
+		_, err := r.execSQL(tx, fmt.Sprintf("UPDATE csv.company SET deleted_at = NOW() WHERE id IN (%s)", idList), args...)
+		return err
+	}
+
+	// Компания перестает числиться в рубриках выгрузки, остальные её рубрики сохраняются
+	if len(opts.Categories) > 0 {
+		for _, category := range opts.Categories {
+			args = append(args, category)
+		}
+		_, err := r.execSQL(tx, fmt.Sprintf(
+			`DELETE cc FROM csv.company_category cc
+			JOIN csv.category cat ON cat.id = cc.category_id
+			WHERE cc.company_id IN (%s) AND cat.name IN (%s)`,
+			idList, placeholderList(len(opts.Categories))), args...)
+		return err
+	}
+
+	// Компания перестает числиться в регионах выгрузки, адреса в других регионах сохраняются
+	for _, region := range opts.Regions {
+		args = append(args, region)
+	}
+	_, err := r.execSQL(tx, fmt.Sprintf(
+		`DELETE cg FROM csv.company_geo cg
+		JOIN csv.geo g ON g.id = cg.geo_id
+		JOIN csv.region rg ON rg.id = g.region_id
+		WHERE cg.company_id IN (%s) AND rg.name IN (%s)`,
+		idList, placeholderList(len(opts.Regions))), args...)
+	return err
+}
+
+// restoreCompanies снимает пометку удаления с компаний, снова появившихся в выгрузке
+func (r *CompanyRepository) restoreCompanies(tx *sql.Tx, companyIDs []int) error {
+	if len(companyIDs) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(companyIDs))
+	for i, companyID := range companyIDs {
+		args[i] = companyID
+	}
+
+	// Загружаем удаленные компании заранее, чтобы пометить импортом только восстановленные
+	rows, err := r.querySQL(tx, fmt.Sprintf(
+		"SELECT id FROM csv.company WHERE deleted_at IS NOT NULL AND id IN (%s) FOR UPDATE",
+		placeholderList(len(companyIDs))), args...)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке удаленных компаний: %v", err))
+		return err
+	}
+	deleted := make([]interface{}, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		deleted = append(deleted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	if _, err := r.execSQL(tx, fmt.Sprintf(
+		"UPDATE csv.company SET deleted_at = NULL WHERE id IN (%s)",
+		placeholderList(len(deleted))), deleted...); err != nil {
+		r.addError(fmt.Sprintf("ошибка при восстановлении компаний: %v", err))
+		return err
+	}
+
+	r.mu.Lock()
+	r.restoredCount += len(deleted)
+	for _, id := range deleted {
+		r.updatedCompanies[id.(int)] = true
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// placeholderList возвращает список из n плейсхолдеров через запятую
+func placeholderList(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
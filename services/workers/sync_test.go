@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMissingFromSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		scoped   []int
+		seen     map[int]bool
+		expected []int
+	}{
+		{"все компании в файле", []int{1, 2, 3}, map[int]bool{1: true, 2: true, 3: true}, []int{}},
+		{"часть компаний отсутствует", []int{1, 2, 3, 4}, map[int]bool{2: true, 4: true}, []int{1, 3}},
+		{"файл без компаний области", []int{1, 2}, map[int]bool{}, []int{1, 2}},
+		{"компании вне области не учитываются", []int{1}, map[int]bool{1: true, 5: true}, []int{}},
+		{"область пуста", nil, map[int]bool{1: true}, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := missingFromSnapshot(tt.scoped, tt.seen)
+			if fmt.Sprint(missing) != fmt.Sprint(tt.expected) {
+				t.Errorf("ожидалось %v, получено %v", tt.expected, missing)
+			}
+		})
+	}
+}
+
+func TestCheckRemoveLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing int
+		scoped  int
+		limit   int
+		allowed bool
+	}{
+		{"в пределах порога", 1, 10, 20, true},
+		{"ровно порог", 2, 10, 20, true},
+		{"больше порога", 3, 10, 20, false},
+		{"порог 0 запрещает удаление", 1, 1000, 0, false},
+		{"порог 100 разрешает удалить все", 10, 10, 100, true},
+		{"доля округляется не в пользу удаления", 1, 6, 16, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRemoveLimit(tt.missing, tt.scoped, tt.limit)
+			if (err == nil) != tt.allowed {
+				t.Errorf("удаление %d из %d при пороге %d%%: ожидалось разрешение %v, ошибка: %v",
+					tt.missing, tt.scoped, tt.limit, tt.allowed, err)
+			}
+		})
+	}
+}
+
+func TestSyncOptionsRemoveLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected int
+		valid    bool
+	}{
+		{"порог не указан - настройка воркера", `{"regions": ["Новосибирская область"]}`, 20, true},
+		{"явный 0 не заменяется", `{"regions": ["Новосибирская область"], "max_remove_percent": 0}`, 0, true},
+		{"явный порог", `{"regions": ["Новосибирская область"], "max_remove_percent": 50}`, 50, true},
+		{"отрицательный порог", `{"regions": ["Новосибирская область"], "max_remove_percent": -1}`, -1, false},
+		{"порог больше 100", `{"regions": ["Новосибирская область"], "max_remove_percent": 101}`, 101, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts SyncOptions
+			if err := json.Unmarshal([]byte(tt.json), &opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := opts.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("ожидалась корректность %v, ошибка: %v", tt.valid, err)
+			}
+
+			opts.ApplyDefaults(20)
+			if limit := opts.removeLimit(); limit != tt.expected {
+				t.Errorf("ожидался порог %d, получен %d", tt.expected, limit)
+			}
+		})
+	}
+
+	// Без порога репозиторий ничего не удаляет
+	if limit := (&SyncOptions{}).removeLimit(); limit != 0 {
+		t.Errorf("порог без настройки: ожидался 0, получен %d", limit)
+	}
+}
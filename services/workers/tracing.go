@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracingServiceName - имя сервиса в трассировках, если не задан OTEL_SERVICE_NAME
+	tracingServiceName = "csv-import-worker"
+
+	// sqlStatementMaxLength - ограничение длины текста запроса в span: пакетные запросы
+	// содержат тысячи плейсхолдеров
+	sqlStatementMaxLength = 1024
+)
+
+// tracer создает span'ы воркера. До вызова InitTracing span'ы не записываются
+var tracer = otel.Tracer("github.com/file-csv-import/workers")
+
+// InitTracing настраивает отправку трассировок по OTLP/HTTP и извлечение контекста трассировки
+// из заголовков сообщений (W3C traceparent). Адрес коллектора и остальные параметры экспортера
+// по умолчанию берутся из стандартных переменных OTEL_EXPORTER_OTLP_*.
+// Перед завершением процесса нужно вызвать Shutdown, чтобы отправить накопленные span'ы
+func InitTracing(ctx context.Context, opts ...otlptracehttp.Option) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME и OTEL_RESOURCE_ATTRIBUTES имеют приоритет над именем по умолчанию
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(tracingServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider, nil
+}
+
+// amqpHeaderCarrier передает контекст трассировки через заголовки сообщения RabbitMQ
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	switch value := c[key].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return ""
+}
+
+func (c amqpHeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// extractTraceContext продолжает трассировку отправителя задачи, если она передана в заголовках
+func extractTraceContext(ctx context.Context, headers amqp.Table) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, amqpHeaderCarrier(headers))
+}
+
+// endSpan отмечает ошибку в span (если она есть) и завершает его
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// sqlSpanName возвращает имя span'а запроса: операция и таблица, например "INSERT csv.company"
+func sqlSpanName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "SQL"
+	}
+
+	operation := strings.ToUpper(fields[0])
+	for i := 1; i < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "INTO", "FROM", "TABLE":
+			// Пропускаем IF NOT EXISTS в CREATE и DROP
+			for _, table := range fields[i+1:] {
+				switch strings.ToUpper(table) {
+				case "IF", "NOT", "EXISTS":
+					continue
+				}
+				return operation + " " + strings.TrimSuffix(table, "(")
+			}
+		}
+	}
+	if operation == "UPDATE" && len(fields) > 1 {
+		return operation + " " + fields[1]
+	}
+	return operation
+}
+
+// sqlSpanAttributes возвращает атрибуты span'а запроса к MySQL
+func sqlSpanAttributes(query string, args int) []attribute.KeyValue {
+	statement := query
+	if len(statement) > sqlStatementMaxLength {
+		statement = statement[:sqlStatementMaxLength] + "..."
+	}
+	return []attribute.KeyValue{
+		semconv.DBSystemMySQL,
+		semconv.DBStatement(statement),
+		attribute.Int("db.args", args),
+	}
+}
+
+// traceStep выполняет этап импорта в отдельном span'е. span'ы запросов и вложенных этапов,
+// начатые внутри fn, становятся его дочерними
+func (r *CompanyRepository) traceStep(name string, fn func() error, attrs ...attribute.KeyValue) error {
+	parent := r.ctx
+	ctx, span := tracer.Start(parent, name, trace.WithAttributes(attrs...))
+	r.ctx = ctx
+
+	err := fn()
+
+	r.ctx = parent
+	endSpan(span, err)
+	return err
+}
+
+// execSQL выполняет запрос в транзакции импорта в span'е текущего этапа.
+// Запрос прерывается при отмене контекста импорта
+func (r *CompanyRepository) execSQL(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := tracer.Start(r.ctx, sqlSpanName(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(sqlSpanAttributes(query, len(args))...))
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err == nil {
+		if affected, affectedErr := result.RowsAffected(); affectedErr == nil {
+			span.SetAttributes(attribute.Int64("db.rows_affected", affected))
+		}
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+// querySQL выполняет запрос на чтение в span'е текущего этапа.
+// span завершается после ответа сервера, чтение строк в него не входит.
+// Запрос прерывается при отмене контекста импорта
+func (r *CompanyRepository) querySQL(tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := tracer.Start(r.ctx, sqlSpanName(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(sqlSpanAttributes(query, len(args))...))
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Контекст трассировки, который PHP-отправитель кладет в заголовки задачи
+const (
+	testTraceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpanID = "00f067aa0ba902b7"
+)
+
+func TestTracingContinuesPublisherTrace(t *testing.T) {
+	// Локальная замена коллектора: принимает OTLP/HTTP и сохраняет полученные span'ы
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("неожиданный путь запроса: %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &request); err != nil {
+			t.Errorf("ошибка разбора OTLP запроса: %v", err)
+		}
+
+		mu.Lock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	provider, err := InitTracing(context.Background(),
+		otlptracehttp.WithEndpoint(strings.TrimPrefix(collector.URL, "http://")),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("ошибка настройки трассировки: %v", err)
+	}
+
+	headers := amqp.Table{"traceparent": "00-" + testTraceID + "-" + testParentSpanID + "-01"}
+	ctx, span := tracer.Start(extractTraceContext(context.Background(), headers), "csv_import_normal process")
+
+	repository := &CompanyRepository{ctx: ctx}
+	_, err = NewCSVParser(nil, nil).ParseFileInBatches(ctx, writeTestFile(t, []byte(testCSV)), 1, func(batch []GisCompany) error {
+		return repository.traceStep("import.batch", func() error { return nil })
+	}, nil)
+	if err != nil {
+		t.Fatalf("ошибка чтения файла: %v", err)
+	}
+	span.End()
+
+	// Shutdown отправляет накопленные span'ы в коллектор
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("ошибка отправки трассировок: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	byName := make(map[string]*tracepb.Span)
+	var reads, batches []*tracepb.Span
+	for _, s := range spans {
+		if hex.EncodeToString(s.TraceId) != testTraceID {
+			t.Errorf("span %s не продолжает трассировку отправителя: %x", s.Name, s.TraceId)
+		}
+		byName[s.Name] = s
+		switch s.Name {
+		case "CSVParser.ReadBatch":
+			reads = append(reads, s)
+		case "import.batch":
+			batches = append(batches, s)
+		}
+	}
+
+	process := byName["csv_import_normal process"]
+	if process == nil {
+		t.Fatalf("span обработки сообщения не получен, получены: %d", len(spans))
+	}
+	if hex.EncodeToString(process.ParentSpanId) != testParentSpanID {
+		t.Errorf("родитель span'а обработки - %x, ожидался span отправителя", process.ParentSpanId)
+	}
+
+	// Порция читается отдельным span'ом, а время её вставки в него не входит
+	// Две порции по одной строке: чтение каждой из них и проверка конца файла
+	if len(reads) != 3 || len(batches) != 2 {
+		t.Fatalf("ожидалось 3 span'а чтения и 2 вставки, получено %d и %d", len(reads), len(batches))
+	}
+	for _, read := range reads {
+		if string(read.ParentSpanId) != string(process.SpanId) {
+			t.Error("span CSVParser.ReadBatch не вложен в обработку сообщения")
+		}
+		for _, batch := range batches {
+			if read.StartTimeUnixNano < batch.EndTimeUnixNano && batch.StartTimeUnixNano < read.EndTimeUnixNano {
+				t.Error("span CSVParser.ReadBatch включает время вставки порции")
+			}
+		}
+	}
+	for _, batch := range batches {
+		if string(batch.ParentSpanId) != string(process.SpanId) {
+			t.Error("span import.batch не вложен в обработку сообщения")
+		}
+	}
+
+	if !hasIntAttribute(process, "csv.rows") {
+		t.Error("итоги чтения файла не добавлены к span'у обработки сообщения")
+	}
+}
+
+// hasIntAttribute сообщает, есть ли у span'а числовой атрибут key
+func hasIntAttribute(span *tracepb.Span, key string) bool {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			_, ok := attr.Value.Value.(*commonpb.AnyValue_IntValue)
+			return ok
+		}
+	}
+	return false
+}
+
+func TestSQLSpanName(t *testing.T) {
+	cases := map[string]string{
+		"INSERT IGNORE INTO csv.company (external_id, name) VALUES (?, ?)": "INSERT csv.company",
+		"SELECT id, name FROM csv.city WHERE name IN (?)":                  "SELECT csv.city",
+		"UPDATE csv.company SET deleted_at = NOW() WHERE id IN (?)":        "UPDATE csv.company",
+		"DELETE cc FROM csv.company_category cc JOIN csv.category cat":     "DELETE csv.company_category",
+		"CREATE TEMPORARY TABLE IF NOT EXISTS tmp_geo (region_id INT)":     "CREATE tmp_geo",
+		"SET FOREIGN_KEY_CHECKS = 0":                                       "SET",
+	}
+	for query, expected := range cases {
+		if name := sqlSpanName(query); name != expected {
+			t.Errorf("sqlSpanName(%q) = %q, ожидалось %q", query, name, expected)
+		}
+	}
+}
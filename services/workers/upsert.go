@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// upsertMaxChanges - сколько изменений компаний перечисляется в статистике импорта.
+// Статистика целиком сохраняется в import_job.summary и отправляется в событии о завершении импорта
+const upsertMaxChanges = 100
+
+// upsertCompanies обновляет компании порции, которые были в БД до импорта: название по ID из выгрузки
+// и наборы контактов, гео, категорий и подкатегорий. Связи, которых нет в файле, удаляются,
+// недостающие вставляются обычными insert*-методами после этого шага.
+// Набор связей компании заменяется один раз за импорт, поэтому компания, встречающаяся
+// в нескольких порциях, получает объединение связей из всех своих строк
+func (r *CompanyRepository) upsertCompanies(tx *sql.Tx, records []GisCompany) error {
+	// Компании порции, существовавшие до импорта
+	companies := make(map[int]GisCompany)
+	linked := make(map[int]bool)
+
+	for _, record := range records {
+		companyID, _ := r.company.Get(r.companyKey(record))
+		r.mu.RLock()
+		created := r.createdCompanies[companyID]
+		r.mu.RUnlock()
+
+		if companyID == 0 || created {
+			continue
+		}
+		companies[companyID] = record
+		// Гео и категории собираются только для строк с гео (см. insertBatch)
+		if r.getGeoID(record) != 0 {
+			linked[companyID] = true
+		}
+	}
+
+	if len(companies) == 0 {
+		return nil
+	}
+
+	if err := r.updateCompanyNames(tx, companies); err != nil {
+		return err
+	}
+
+	// Компании, помеченные удаленными при синхронизации, снова есть в выгрузке
+	companyIDs := make([]int, 0, len(companies))
+	for companyID := range companies {
+		companyIDs = append(companyIDs, companyID)
+	}
+	if err := r.restoreCompanies(tx, companyIDs); err != nil {
+		return err
+	}
+
+	if err := r.replaceContacts(tx, companies); err != nil {
+		return err
+	}
+
+	linkedIDs := make([]int, 0, len(linked))
+	for companyID := range linked {
+		linkedIDs = append(linkedIDs, companyID)
+	}
+	for _, linkType := range []string{"geo", "category", "subcategory"} {
+		if err := r.replaceLinks(tx, linkType, companies, linkedIDs); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	for companyID := range companies {
+		r.replacedContacts[companyID] = true
+	}
+	for companyID := range linked {
+		r.replacedLinks[companyID] = true
+	}
+	r.mu.Unlock()
+
+	return nil
+}
+
+// updateCompanyNames обновляет названия компаний, сопоставленных по ID из выгрузки
+func (r *CompanyRepository) updateCompanyNames(tx *sql.Tx, companies map[int]GisCompany) error {
+	ids := make([]interface{}, 0, len(companies))
+	for companyID, record := range companies {
+		if record.ExternalID != "" {
+			ids = append(ids, companyID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := r.querySQL(tx, fmt.Sprintf("SELECT id, name FROM csv.company WHERE id IN (%s)", placeholders), ids...)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке компаний: %v", err))
+		return err
+	}
+
+	var cases []string
+	var caseArgs, idArgs []interface{}
+	for rows.Next() {
+		var companyID int
+		var name string
+		if err := rows.Scan(&companyID, &name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		record := companies[companyID]
+		if name == record.Name {
+			continue
+		}
+
+		cases = append(cases, "WHEN ? THEN ?")
+		caseArgs = append(caseArgs, companyID, record.Name)
+		idArgs = append(idArgs, companyID)
+
+		r.mu.Lock()
+		r.change(companyID, record).OldName = name
+		r.mu.Unlock()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(idArgs) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf("UPDATE csv.company SET name = CASE id %s END WHERE id IN (%s)",
+		strings.Join(cases, " "), strings.TrimSuffix(strings.Repeat("?,", len(idArgs)), ","))
+	if _, err := r.execSQL(tx, query, append(caseArgs, idArgs...)...); err != nil {
+		r.addError(fmt.Sprintf("ошибка при обновлении компаний: %v", err))
+		return err
+	}
+	return nil
+}
+
+// replaceContacts удаляет контакты компаний, которых нет в файле, и отмечает добавленные
+func (r *CompanyRepository) replaceContacts(tx *sql.Tx, companies map[int]GisCompany) error {
+	companyIDs := make([]int, 0, len(companies))
+	for companyID := range companies {
+		companyIDs = append(companyIDs, companyID)
+	}
+
+	// contactID -> значение для каждой компании и типа контакта
+	existing := make(map[int]map[string]map[string][]int)
+	for i := 0; i < len(companyIDs); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(companyIDs) {
+			end = len(companyIDs)
+		}
+		batch := companyIDs[i:end]
+
+		args := make([]interface{}, len(batch))
+		for j, companyID := range batch {
+			args[j] = companyID
+		}
+		query := fmt.Sprintf("SELECT id, company_id, phone, email FROM csv.company_contact WHERE company_id IN (%s)",
+			strings.TrimSuffix(strings.Repeat("?,", len(batch)), ","))
+
+		rows, err := r.querySQL(tx, query, args...)
+		if err != nil {
+			r.addError(fmt.Sprintf("ошибка при загрузке контактов: %v", err))
+			return err
+		}
+		for rows.Next() {
+			var id, companyID int
+			var phone, email sql.NullString
+			if err := rows.Scan(&id, &companyID, &phone, &email); err != nil {
+				rows.Close()
+				return err
+			}
+			if existing[companyID] == nil {
+				existing[companyID] = map[string]map[string][]int{"phone": {}, "email": {}}
+			}
+			if phone.Valid {
+				existing[companyID]["phone"][phone.String] = append(existing[companyID]["phone"][phone.String], id)
+			}
+			if email.Valid {
+				value := strings.ToLower(email.String)
+				existing[companyID]["email"][value] = append(existing[companyID]["email"][value], id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	var removeIDs []int
+	r.mu.Lock()
+	for _, companyID := range companyIDs {
+		for _, contactType := range []string{"phone", "email"} {
+			desired := make(map[string]bool)
+			for _, value := range r.companyContacts[companyID][contactType] {
+				desired[value] = true
+			}
+			current := existing[companyID][contactType]
+
+			var added, removed []string
+			for value := range desired {
+				if _, exists := current[value]; !exists {
+					added = append(added, value)
+				}
+			}
+			if !r.replacedContacts[companyID] {
+				for value, ids := range current {
+					if !desired[value] {
+						removed = append(removed, value)
+						removeIDs = append(removeIDs, ids...)
+					}
+				}
+			}
+
+			if change := newSetChange(added, removed); change != nil {
+				companyChange := r.change(companyID, companies[companyID])
+				if contactType == "phone" {
+					companyChange.Phones = companyChange.Phones.merge(change)
+				} else {
+					companyChange.Emails = companyChange.Emails.merge(change)
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for i := 0; i < len(removeIDs); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(removeIDs) {
+			end = len(removeIDs)
+		}
+		batch := removeIDs[i:end]
+
+		args := make([]interface{}, len(batch))
+		for j, id := range batch {
+			args[j] = id
+		}
+		query := fmt.Sprintf("DELETE FROM csv.company_contact WHERE id IN (%s)",
+			strings.TrimSuffix(strings.Repeat("?,", len(batch)), ","))
+		if _, err := r.execSQL(tx, query, args...); err != nil {
+			r.addError(fmt.Sprintf("ошибка при удалении контактов: %v", err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceLinks удаляет связи компаний с гео, категориями или подкатегориями (linkType),
+// которых нет в файле, и отмечает добавленные
+func (r *CompanyRepository) replaceLinks(tx *sql.Tx, linkType string, companies map[int]GisCompany, companyIDs []int) error {
+	if len(companyIDs) == 0 {
+		return nil
+	}
+
+	existing, err := r.loadLinks(tx, linkType, companyIDs)
+	if err != nil {
+		r.addError(fmt.Sprintf("ошибка при загрузке связей company_%s: %v", linkType, err))
+		return err
+	}
+
+	var removeLinks [][2]int
+	added := make(map[int][]int)
+	removed := make(map[int][]int)
+	var changedIDs []int
+
+	r.mu.RLock()
+	for _, companyID := range companyIDs {
+		var linkIDs []int
+		if linkType == "geo" {
+			linkIDs = r.companyGeos[companyID]
+		} else {
+			linkIDs = r.companyCategories[companyID][linkType]
+		}
+
+		desired := make(map[int]bool)
+		for _, id := range linkIDs {
+			desired[id] = true
+			if !existing[companyID][id] {
+				added[companyID] = append(added[companyID], id)
+			}
+		}
+		if !r.replacedLinks[companyID] {
+			for id := range existing[companyID] {
+				if !desired[id] {
+					removed[companyID] = append(removed[companyID], id)
+					removeLinks = append(removeLinks, [2]int{companyID, id})
+				}
+			}
+		}
+
+		if len(added[companyID]) > 0 || len(removed[companyID]) > 0 {
+			changedIDs = append(changedIDs, companyID)
+		}
+	}
+	r.mu.RUnlock()
+
+	for i := 0; i < len(removeLinks); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(removeLinks) {
+			end = len(removeLinks)
+		}
+		batch := removeLinks[i:end]
+
+		args := make([]interface{}, 0, len(batch)*2)
+		for _, link := range batch {
+			args = append(args, link[0], link[1])
+		}
+		query := fmt.Sprintf("DELETE FROM csv.company_%s WHERE (company_id, %s_id) IN (%s)",
+			linkType, linkType, strings.TrimSuffix(strings.Repeat("(?, ?),", len(batch)), ","))
+		if _, err := r.execSQL(tx, query, args...); err != nil {
+			r.addError(fmt.Sprintf("ошибка при удалении связей company_%s: %v", linkType, err))
+			return err
+		}
+	}
+
+	if len(changedIDs) == 0 {
+		return nil
+	}
+
+	// В отчете категории и подкатегории указываются названиями, гео - ID
+	var names map[int]string
+	if linkType != "geo" {
+		var ids []int
+		for _, companyID := range changedIDs {
+			ids = append(ids, added[companyID]...)
+			ids = append(ids, removed[companyID]...)
+		}
+		if names, err = r.dictionaryNames(tx, linkType, r.uniqueInts(ids)); err != nil {
+			return err
+		}
+	}
+	label := func(ids []int) []string {
+		values := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if name, ok := names[id]; ok {
+				values = append(values, name)
+			} else {
+				values = append(values, strconv.Itoa(id))
+			}
+		}
+		return values
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, companyID := range changedIDs {
+		change := newSetChange(label(added[companyID]), label(removed[companyID]))
+		companyChange := r.change(companyID, companies[companyID])
+		switch linkType {
+		case "geo":
+			companyChange.Geo = companyChange.Geo.merge(change)
+		case "category":
+			companyChange.Categories = companyChange.Categories.merge(change)
+		case "subcategory":
+			companyChange.Subcategories = companyChange.Subcategories.merge(change)
+		}
+	}
+
+	return nil
+}
+
+// loadLinks загружает связи компаний из company_<linkType>: компания -> множество ID
+func (r *CompanyRepository) loadLinks(tx *sql.Tx, linkType string, companyIDs []int) (map[int]map[int]bool, error) {
+	links := make(map[int]map[int]bool)
+
+	for i := 0; i < len(companyIDs); i += pivotBatchSize {
+		end := i + pivotBatchSize
+		if end > len(companyIDs) {
+			end = len(companyIDs)
+		}
+		batch := companyIDs[i:end]
+
+		args := make([]interface{}, len(batch))
+		for j, companyID := range batch {
+			args[j] = companyID
+		}
+		query := fmt.Sprintf("SELECT company_id, %s_id FROM csv.company_%s WHERE company_id IN (%s)",
+			linkType, linkType, strings.TrimSuffix(strings.Repeat("?,", len(batch)), ","))
+
+		rows, err := r.querySQL(tx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var companyID, id int
+			if err := rows.Scan(&companyID, &id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if links[companyID] == nil {
+				links[companyID] = make(map[int]bool)
+			}
+			links[companyID][id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return links, nil
+}
+
+// dictionaryNames возвращает названия записей справочника по ID: из кэша, а отсутствующие - из БД
+func (r *CompanyRepository) dictionaryNames(tx *sql.Tx, table string, ids []int) (map[int]string, error) {
+	names := make(map[int]string, len(ids))
+
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	r.getCacheForTable(table).Each(func(name string, id int) {
+		if wanted[id] {
+			names[id] = name
+		}
+	})
+
+	var missing []interface{}
+	for _, id := range ids {
+		if _, ok := names[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return names, nil
+	}
+
+	query := fmt.Sprintf("SELECT id, name FROM csv.%s WHERE id IN (%s)",
+		table, strings.TrimSuffix(strings.Repeat("?,", len(missing)), ","))
+	rows, err := r.querySQL(tx, query, missing...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+
+	return names, rows.Err()
+}
+
+// change возвращает запись об изменениях компании, создавая её при первом изменении.
+// Вызывается под r.mu
+func (r *CompanyRepository) change(companyID int, record GisCompany) *CompanyChange {
+	if change, exists := r.changes[companyID]; exists {
+		return change
+	}
+
+	change := &CompanyChange{
+		CompanyID:  companyID,
+		ExternalID: record.ExternalID,
+		Name:       record.Name,
+	}
+	r.changes[companyID] = change
+	r.changeOrder = append(r.changeOrder, companyID)
+	r.updatedCompanies[companyID] = true
+	return change
+}
+
+// companyChanges возвращает первые upsertMaxChanges изменений компаний текущего импорта в порядке их обнаружения
+// и количество изменений, не попавших в список. Вызывается под r.mu
+func (r *CompanyRepository) companyChanges() ([]CompanyChange, int) {
+	if len(r.changeOrder) == 0 {
+		return nil, 0
+	}
+
+	listed := r.changeOrder
+	if len(listed) > upsertMaxChanges {
+		listed = listed[:upsertMaxChanges]
+	}
+
+	changes := make([]CompanyChange, 0, len(listed))
+	for _, companyID := range listed {
+		changes = append(changes, *r.changes[companyID])
+	}
+	return changes, len(r.changeOrder) - len(listed)
+}
+
+// newSetChange возвращает изменение набора или nil, если набор не изменился
+func newSetChange(added []string, removed []string) *SetChange {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return &SetChange{Added: added, Removed: removed}
+}
+
+// merge объединяет изменения набора из разных порций импорта
+func (c *SetChange) merge(other *SetChange) *SetChange {
+	if c == nil {
+		return other
+	}
+	if other == nil {
+		return c
+	}
+	return newSetChange(append(c.Added, other.Added...), append(c.Removed, other.Removed...))
+}
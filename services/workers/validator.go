@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// emailPattern - упрощенная проверка синтаксиса email: local@domain.tld
+	emailPattern = regexp.MustCompile(`^[^\s@,;]+@[^\s@,;]+\.[^\s@,;.]{2,}$`)
+	// phonePattern - цифры, пробелы, скобки, плюс, точки и разные виды дефисов
+	phonePattern = regexp.MustCompile(`^\+?[0-9\s().\-‒–—]+$`)
+)
+
+const (
+	phoneMinDigits = 5
+	phoneMaxDigits = 15
+)
+
+// ValidationRules описывает правила проверки строк CSV.
+// Списковые поля (email, phone, category, subcategory) проверяются поэлементно
+//
+// Пример:
+//
+//	{
+//	  "require_name": true,
+//	  "email": true,
+//	  "phone": false,
+//	  "max_length": {"name": 255, "category": 100}
+//	}
+type ValidationRules struct {
+	// RequireName - строка без названия компании отклоняется
+	RequireName *bool `json:"require_name,omitempty"`
+	// Email - проверять синтаксис email
+	Email *bool `json:"email,omitempty"`
+	// Phone - проверять формат телефонов
+	Phone *bool `json:"phone,omitempty"`
+	// MaxLength - поле -> максимальная длина значения в символах, 0 отключает проверку
+	MaxLength map[string]int `json:"max_length,omitempty"`
+}
+
+// DefaultValidationRules возвращает правила, соответствующие размерам VARCHAR в схеме БД
+func DefaultValidationRules() *ValidationRules {
+	enabled := true
+	return &ValidationRules{
+		RequireName: &enabled,
+		Email:       &enabled,
+		Phone:       &enabled,
+		MaxLength: map[string]int{
+			FieldName:        255,
+			FieldRegion:      255,
+			FieldDistrict:    255,
+			FieldCity:        255,
+			FieldEmail:       contactMaxLength,
+			FieldPhone:       contactMaxLength,
+			FieldCategory:    100,
+			FieldSubcategory: 100,
+		},
+	}
+}
+
+// LoadValidationRules загружает правила проверки из JSON файла.
+// Правила, не указанные в файле, берутся из DefaultValidationRules
+func LoadValidationRules(path string) (*ValidationRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла правил проверки: %w", err)
+	}
+
+	var rules ValidationRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("ошибка разбора файла правил проверки: %w", err)
+	}
+
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+
+	return DefaultValidationRules().Merge(&rules), nil
+}
+
+// Validate проверяет, что ограничения длины указаны для известных полей
+func (v *ValidationRules) Validate() error {
+	for field, length := range v.MaxLength {
+		if !isCompanyField(field) {
+			return fmt.Errorf("неизвестное поле в правилах проверки: %s", field)
+		}
+		if length < 0 {
+			return fmt.Errorf("отрицательная максимальная длина для поля %s", field)
+		}
+	}
+	return nil
+}
+
+// Merge возвращает новые правила, в которых заданные в override значения заменяют текущие
+func (v *ValidationRules) Merge(override *ValidationRules) *ValidationRules {
+	merged := &ValidationRules{
+		RequireName: v.RequireName,
+		Email:       v.Email,
+		Phone:       v.Phone,
+		MaxLength:   make(map[string]int, len(v.MaxLength)),
+	}
+	for field, length := range v.MaxLength {
+		merged.MaxLength[field] = length
+	}
+
+	if override == nil {
+		return merged
+	}
+	if override.RequireName != nil {
+		merged.RequireName = override.RequireName
+	}
+	if override.Email != nil {
+		merged.Email = override.Email
+	}
+	if override.Phone != nil {
+		merged.Phone = override.Phone
+	}
+	for field, length := range override.MaxLength {
+		merged.MaxLength[field] = length
+	}
+
+	return merged
+}
+
+// Check проверяет запись и возвращает причины отклонения (пусто, если запись корректна)
+func (v *ValidationRules) Check(record GisCompany) []string {
+	var reasons []string
+
+	if isEnabled(v.RequireName) && record.Name == "" {
+		reasons = append(reasons, "пустое название")
+	}
+
+	// ID из выгрузки необязателен, но если указан, должен быть числом (колонка BIGINT UNSIGNED)
+	if record.ExternalID != "" && !isValidExternalID(record.ExternalID) {
+		reasons = append(reasons, fmt.Sprintf("некорректный ID: %s", record.ExternalID))
+	}
+
+	scalars := []struct {
+		field string
+		value string
+	}{
+		{FieldName, record.Name},
+		{FieldRegion, record.Region},
+		{FieldDistrict, record.District},
+		{FieldCity, record.City},
+	}
+	for _, s := range scalars {
+		reasons = v.checkLength(reasons, s.field, s.value)
+	}
+
+	for _, email := range splitList(record.Email) {
+		if isEnabled(v.Email) && !emailPattern.MatchString(email) {
+			reasons = append(reasons, fmt.Sprintf("некорректный email: %s", email))
+		}
+		reasons = v.checkLength(reasons, FieldEmail, email)
+	}
+
+	for _, phone := range splitList(record.Phone) {
+		if isEnabled(v.Phone) && !isValidPhone(phone) {
+			reasons = append(reasons, fmt.Sprintf("некорректный телефон: %s", phone))
+		}
+		reasons = v.checkLength(reasons, FieldPhone, phone)
+	}
+
+	for _, category := range splitList(record.Category) {
+		reasons = v.checkLength(reasons, FieldCategory, category)
+	}
+	for _, subcategory := range splitList(record.Subcategory) {
+		reasons = v.checkLength(reasons, FieldSubcategory, subcategory)
+	}
+
+	return reasons
+}
+
+// checkLength добавляет причину, если значение длиннее допустимого для поля
+func (v *ValidationRules) checkLength(reasons []string, field string, value string) []string {
+	limit := v.MaxLength[field]
+	if limit > 0 && utf8.RuneCountInString(value) > limit {
+		return append(reasons, fmt.Sprintf("поле %s длиннее %d символов", field, limit))
+	}
+	return reasons
+}
+
+// isValidExternalID проверяет, что ID - положительное целое число, помещающееся в BIGINT UNSIGNED
+func isValidExternalID(id string) bool {
+	value, err := strconv.ParseUint(id, 10, 64)
+	return err == nil && value > 0
+}
+
+// isValidPhone проверяет допустимые символы и количество цифр в номере
+func isValidPhone(phone string) bool {
+	if !phonePattern.MatchString(phone) {
+		return false
+	}
+
+	digits := 0
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= phoneMinDigits && digits <= phoneMaxDigits
+}
+
+// splitList разбивает значение, разделенное запятой, на непустые элементы
+func splitList(commaValues string) []string {
+	if commaValues == "" {
+		return nil
+	}
+
+	values := strings.Split(commaValues, ",")
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func isEnabled(flag *bool) bool {
+	return flag != nil && *flag
+}
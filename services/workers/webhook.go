@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Заголовки уведомления о завершении импорта
+const (
+	webhookSignatureHeader = "X-Import-Signature"
+	webhookEventHeader     = "X-Import-Event"
+
+	// webhookRetryBaseDelay - задержка перед второй попыткой, далее удваивается
+	webhookRetryBaseDelay = time.Second
+)
+
+// WebhookNotifier отправляет события о завершении импорта POST-запросом на callback_url задачи.
+// Тело подписывается HMAC-SHA256 с общим секретом, подпись передается в заголовке
+// X-Import-Signature в виде sha256=<hex>. Неудачные запросы повторяются с экспоненциальной задержкой
+type WebhookNotifier struct {
+	client      *http.Client
+	secret      []byte
+	maxAttempts int
+	retryDelay  time.Duration
+
+	// Уведомления отправляются в фоне, чтобы медленный получатель не задерживал обработку очереди
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending sync.WaitGroup
+}
+
+// NewWebhookNotifier создает отправителя уведомлений. Без секрета уведомления не отправляются
+func NewWebhookNotifier(secret string, timeout time.Duration, maxAttempts int, retryDelay time.Duration) *WebhookNotifier {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookNotifier{
+		client:      &http.Client{Timeout: timeout},
+		secret:      []byte(secret),
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Notify отправляет уведомление в фоне. Ошибки пишутся в logger
+func (n *WebhookNotifier) Notify(callbackURL string, event string, payload []byte, logger *slog.Logger) {
+	n.pending.Add(1)
+	go func() {
+		defer n.pending.Done()
+		if err := n.Send(n.ctx, callbackURL, event, payload); err != nil {
+			logger.Error("Ошибка отправки уведомления", "error", err)
+		}
+	}()
+}
+
+// Send отправляет уведомление, повторяя запрос при сетевой ошибке, ответе 429 или 5xx
+func (n *WebhookNotifier) Send(ctx context.Context, callbackURL string, event string, payload []byte) error {
+	if len(n.secret) == 0 {
+		return fmt.Errorf("уведомление на %s не отправлено: не задан секрет подписи WORKER_WEBHOOK_SECRET", callbackURL)
+	}
+
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("некорректный callback_url: %s", callbackURL)
+	}
+
+	signature := signWebhookPayload(n.secret, payload)
+	delay := n.retryDelay
+
+	var lastErr error
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		retry, err := n.post(ctx, callbackURL, event, signature, payload)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == n.maxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("уведомление на %s прервано: %w", callbackURL, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	return fmt.Errorf("уведомление на %s не доставлено: %w", callbackURL, lastErr)
+}
+
+// post выполняет одну попытку. retry сообщает, имеет ли смысл повторять запрос
+func (n *WebhookNotifier) post(ctx context.Context, callbackURL string, event string, signature string, payload []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("получатель ответил %s", resp.Status)
+}
+
+// Wait ждет отправки фоновых уведомлений. Если ctx истекает раньше, оставшиеся отправки прерываются
+func (n *WebhookNotifier) Wait(ctx context.Context) {
+	sent := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		n.cancel()
+		<-sent
+	}
+	n.cancel()
+}
+
+// signWebhookPayload возвращает подпись тела уведомления: sha256=<hex HMAC-SHA256>
+func signWebhookPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifierRetriesAndSigns(t *testing.T) {
+	payload := []byte(`{"job_id":42,"status":"done"}`)
+	expected := signWebhookPayload([]byte("secret"), payload)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != string(payload) {
+			t.Errorf("неверное тело уведомления: %s", body)
+		}
+		if signature := r.Header.Get(webhookSignatureHeader); signature != expected {
+			t.Errorf("неверная подпись: %s, ожидалась %s", signature, expected)
+		}
+		if event := r.Header.Get(webhookEventHeader); event != "done" {
+			t.Errorf("неверное событие: %s", event)
+		}
+
+		// Первые две попытки завершаются ошибкой получателя
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier("secret", time.Second, 5, time.Millisecond)
+	if err := notifier.Send(context.Background(), server.URL, "done", payload); err != nil {
+		t.Fatalf("уведомление не доставлено: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("ожидалось 3 попытки, выполнено %d", calls)
+	}
+}
+
+func TestWebhookNotifierDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier("secret", time.Second, 5, time.Millisecond)
+	if err := notifier.Send(context.Background(), server.URL, "failed", []byte(`{}`)); err == nil {
+		t.Fatal("ожидалась ошибка доставки")
+	}
+	if calls != 1 {
+		t.Errorf("ответ 400 не должен повторяться, выполнено %d попыток", calls)
+	}
+
+	unsigned := NewWebhookNotifier("", time.Second, 5, time.Millisecond)
+	if err := unsigned.Send(context.Background(), server.URL, "failed", []byte(`{}`)); err == nil {
+		t.Error("без секрета уведомление не должно отправляться")
+	}
+	if calls != 1 {
+		t.Errorf("без секрета запрос не должен выполняться, выполнено %d попыток", calls)
+	}
+}
@@ -1,76 +1,81 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Worker обрабатывает задачи из RabbitMQ
+// deadLetterReasonMaxLength - ограничение длины текста ошибки в заголовке x-error
+const deadLetterReasonMaxLength = 4096
+
+// Worker обрабатывает задачи из RabbitMQ. Потребители одной очереди используют общее соединение,
+// но у каждого свой канал и свой репозиторий, чтобы кэши не блокировали параллельные импорты
 type Worker struct {
-	conn          *amqp.Connection
-	channel       *amqp.Channel
-	repository    *CompanyRepository
-	queueName     string
-	prefetchCount int
-	csvParser     *CSVParser
-	storagePath   string
-	workerID      string
+	connection           *AMQPConnection
+	channel              *amqp.Channel
+	closeNotify          chan *amqp.Error
+	closing              bool
+	consuming            bool
+	done                 chan struct{}
+	mu                   sync.RWMutex
+	inflight             sync.WaitGroup
+	progressAt           atomic.Int64
+	importCtx            context.Context
+	cancelImport         context.CancelFunc
+	repository           *CompanyRepository
+	jobs                 *JobRepository
+	dedup                *DedupRepository
+	queueName            string
+	deadLetterExchange   string
+	deadLetterQueue      string
+	resultExchange       string
+	webhooks             *WebhookNotifier
+	retryPolicy          RetryPolicy
+	syncMaxRemovePercent int
+	prefetchCount        int
+	batchSize            int
+	csvParser            *CSVParser
+	storagePath          string
+	workerID             string
+	logger               *slog.Logger
 }
 
-// NewWorker создает новый воркер
-func NewWorker(config *Config, db *sql.DB, queueName string) (*Worker, error) {
-	conn, err := amqp.Dial(config.RabbitMQURL)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка подключения к RabbitMQ: %w", err)
-	}
+// NewWorker создает потребителя очереди с номером consumer (начиная с 1) и открывает канал на общем соединении
+func NewWorker(config *Config, db *sql.DB, conn *AMQPConnection, queueName string, consumer int) (*Worker, error) {
+	var err error
 
-	ch, err := conn.Channel()
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("ошибка создания канала: %w", err)
-	}
-
-	// Устанавливаем prefetch count
-	if err := ch.Qos(config.PrefetchCount, 0, false); err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("ошибка установки Qos: %w", err)
+	// Загружаем сопоставление колонок CSV, если задан файл
+	mapping := DefaultColumnMapping()
+	if config.ColumnMappingPath != "" {
+		mapping, err = LoadColumnMapping(config.ColumnMappingPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Определяем аргументы очереди в зависимости от её типа
-	args := make(amqp.Table)
-	
-	// Устанавливаем x-max-priority в зависимости от очереди
-	switch queueName {
-	case "csv_import_high":
-		args["x-max-priority"] = 10
-	case "csv_import_normal":
-		args["x-max-priority"] = 5
-	case "csv_import_large":
-		args["x-max-priority"] = 1
-	}
-
-	// Объявляем очередь (не создаем, если уже существует)
-	_, err = ch.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		args,      // arguments
-	)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("ошибка объявления очереди: %w", err)
+	// Загружаем правила проверки строк, если задан файл
+	rules := DefaultValidationRules()
+	if config.ValidationRulesPath != "" {
+		rules, err = LoadValidationRules(config.ValidationRulesPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Генерируем уникальный ID воркера
@@ -79,121 +84,410 @@ func NewWorker(config *Config, db *sql.DB, queueName string) (*Worker, error) {
 		hostname = "unknown"
 	}
 	workerID := fmt.Sprintf("worker-%s-%s", queueName, hostname)
+	if config.ConcurrencyFor(queueName) > 1 {
+		workerID = fmt.Sprintf("%s-%d", workerID, consumer)
+	}
 
-	return &Worker{
-		conn:          conn,
-		channel:       ch,
-		repository:    NewCompanyRepository(db),
-		queueName:     queueName,
-		prefetchCount: config.PrefetchCount,
-		csvParser:     NewCSVParser(),
-		storagePath:   config.StoragePath,
-		workerID:      workerID,
-	}, nil
+	// Контекст импорта отменяется, если задача не успела завершиться при остановке воркера
+	importCtx, cancelImport := context.WithCancel(context.Background())
+
+	w := &Worker{
+		connection:           conn,
+		done:                 make(chan struct{}),
+		importCtx:            importCtx,
+		cancelImport:         cancelImport,
+		repository:           NewCompanyRepository(db, config.CacheSize),
+		jobs:                 NewJobRepository(db),
+		dedup:                NewDedupRepository(db),
+		queueName:            queueName,
+		deadLetterExchange:   config.DeadLetterExchange,
+		deadLetterQueue:      config.DeadLetterQueue,
+		resultExchange:       config.ResultExchange,
+		webhooks:             NewWebhookNotifier(config.WebhookSecret, config.WebhookTimeout, config.WebhookMaxAttempts, webhookRetryBaseDelay),
+		retryPolicy:          NewRetryPolicy(config.MaxRetries, config.RetryBaseDelay, config.RetryMaxDelay),
+		syncMaxRemovePercent: config.SyncMaxRemovePercent,
+		prefetchCount:        config.PrefetchCount,
+		batchSize:            config.BatchSize,
+		csvParser:            NewCSVParser(mapping, rules),
+		storagePath:          config.StoragePath,
+		workerID:             workerID,
+		logger:               slog.Default().With(logFieldWorkerID, workerID, logFieldQueue, queueName),
+	}
+
+	// Первое подключение выполняется сразу, чтобы ошибки конфигурации были видны при старте
+	if err := w.connect(); err != nil {
+		cancelImport()
+		return nil, err
+	}
+
+	return w, nil
 }
 
-// Start запускает воркер для обработки задач
+// Start запускает воркер для обработки задач.
+// При потере соединения или канала воркер переподключается и заново регистрирует потребителя.
+// Возвращает управление после вызова Shutdown или Close
 func (w *Worker) Start() error {
-	msgs, err := w.channel.Consume(
+	for {
+		msgs, err := w.consume()
+		if err != nil {
+			// Если очередь уже занята другим эксклюзивным потребителем, это нормально
+			if strings.Contains(err.Error(), "exclusive") || strings.Contains(err.Error(), "RESOURCE_LOCKED") {
+				w.logger.Warn("Очередь уже обрабатывается другим воркером, пропускаем")
+				return nil
+			}
+			if w.isClosing() {
+				return nil
+			}
+			w.logger.Error("Ошибка подписки на очередь", "error", err)
+		} else {
+			w.logger.Info("Воркер успешно подключен к очереди")
+
+			w.setConsuming(true)
+			reason := w.consumeLoop(msgs)
+			w.setConsuming(false)
+			if reason != nil {
+				w.logger.Warn("Соединение с RabbitMQ потеряно", "error", reason)
+			}
+		}
+
+		if w.isClosing() {
+			return nil
+		}
+
+		// Переподключаемся с экспоненциальной задержкой, пока не получится или воркер не остановят
+		if !w.reconnect() {
+			return nil
+		}
+	}
+}
+
+// consume регистрирует потребителя на текущем канале
+func (w *Worker) consume() (<-chan amqp.Delivery, error) {
+	msgs, err := w.currentChannel().Consume(
 		w.queueName, // queue
-		"",          // consumer
+		w.workerID,  // consumer
 		false,       // auto-ack
 		false,       // exclusive - разрешаем несколько воркеров на очередь
 		false,       // no-local
 		false,       // no-wait
 		nil,         // args
 	)
-		if err != nil {
-			// Если очередь уже занята другим эксклюзивным потребителем, это нормально
-			if strings.Contains(err.Error(), "exclusive") || strings.Contains(err.Error(), "RESOURCE_LOCKED") {
-				log.Printf("[%s] Очередь %s уже обрабатывается другим воркером, пропускаем...", w.workerID, w.queueName)
-				return nil
+	if err != nil {
+		return nil, fmt.Errorf("ошибка регистрации потребителя: %w", err)
+	}
+	return msgs, nil
+}
+
+// consumeLoop обрабатывает сообщения, пока канал не будет закрыт или воркер не начнет остановку.
+// Возвращает причину закрытия канала (nil при штатном закрытии)
+func (w *Worker) consumeLoop(msgs <-chan amqp.Delivery) *amqp.Error {
+	w.mu.RLock()
+	closeNotify := w.closeNotify
+	w.mu.RUnlock()
+
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				// Канал доставки закрывается вместе с каналом AMQP, забираем причину, если она есть
+				select {
+				case reason := <-closeNotify:
+					return reason
+				case <-w.done:
+					return nil
+				case <-time.After(time.Second):
+					return nil
+				}
 			}
-			return fmt.Errorf("ошибка регистрации потребителя: %w", err)
+
+			// Сообщения, полученные после начала остановки, возвращаем в очередь необработанными.
+			// Они не учитываются как полученные, чтобы повторная доставка не была посчитана дважды
+			if !w.beginDelivery() {
+				w.nack(d, true, w.logger)
+				continue
+			}
+			messagesConsumed.WithLabelValues(w.queueName).Inc()
+			w.touchProgress()
+			w.handleDelivery(d)
+			w.clearProgress()
+			w.inflight.Done()
+		case reason := <-closeNotify:
+			return reason
+		case <-w.done:
+			return nil
 		}
+	}
+}
 
-		log.Printf("[%s] Воркер успешно подключен к очереди %s (эксклюзивный режим)", w.workerID, w.queueName)
+// handleDelivery обрабатывает одно сообщение и подтверждает, откладывает или отклоняет его
+func (w *Worker) handleDelivery(d amqp.Delivery) {
+	retryCount := getRetryCount(d.Headers)
+	jobID := w.resolveJob(d)
+	// Логгер задачи дополняется ID импорта в processMessage и используется во всех записях о сообщении
+	logger := w.taskLogger(d, jobID)
+	result := &ImportResult{
+		JobID:     jobID,
+		MessageID: d.MessageId,
+		Queue:     w.queueName,
+		WorkerID:  w.workerID,
+		Attempt:   retryCount + 1,
+		StartedAt: time.Now(),
+	}
+	
+	// Обработка продолжает трассировку отправителя задачи (заголовок traceparent)
+	ctx, span := tracer.Start(extractTraceContext(w.importCtx, d.Headers), w.queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("rabbitmq"),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingDestinationName(w.queueName),
+			semconv.MessagingMessageID(d.MessageId),
+			attribute.String("import.worker_id", w.workerID),
+			attribute.Int64("import.job_id", jobID),
+			attribute.Int("import.attempt", retryCount+1),
+		))
 
-	forever := make(chan bool)
+	err := w.processMessage(ctx, d, jobID, result, logger)
+	defer endSpan(span, err)
 
-	go func() {
-		for d := range msgs {
-			retryCount := getRetryCount(d.Headers)
-			maxRetries := 10 // Максимальное количество попыток
-			
-			if err := w.processMessage(d); err != nil {
-				// Проверяем, является ли ошибка deadlock или временной
-				isRetryable := isRetryableError(err)
-				
-				if isRetryable && retryCount < maxRetries {
-					newRetryCount := retryCount + 1
-					
-					// Задержка перед возвратом в очередь (экспоненциальная: 1s, 2s, 3s, 4s, 5s...)
-					time.Sleep(time.Duration(newRetryCount) * time.Second)
-					
-					// Обновляем заголовки с новым счетчиком попыток
-					newHeaders := make(amqp.Table)
-					if d.Headers != nil {
-						for k, v := range d.Headers {
-							newHeaders[k] = v
-						}
-					}
-					newHeaders["x-retry-count"] = newRetryCount
-					
-					// Перепубликуем сообщение с обновленным счетчиком попыток
-					pubErr := w.channel.Publish(
-						"",          // exchange (используем default exchange для прямой публикации в очередь)
-						w.queueName, // routing key (имя очереди)
-						false,       // mandatory
-						false,       // immediate
-						amqp.Publishing{
-							Body:         d.Body,
-							Headers:      newHeaders,
-							DeliveryMode: amqp.Persistent, // 2 - persistent
-							Priority:     d.Priority,
-							MessageId:    d.MessageId,
-							Timestamp:    time.Now(),
-						},
-					)
-					
-					if pubErr != nil {
-						// Fallback к обычному requeue если перепубликация не удалась
-						d.Nack(false, true)
-					} else {
-						// Подтверждаем старое сообщение после успешной перепубликации
-						d.Ack(false)
-					}
-				} else {
-					// Извлекаем название файла из сообщения или используем MessageId
-					fileName := d.MessageId
-					var task ImportTask
-					if json.Unmarshal(d.Body, &task) == nil {
-						fileName = task.FileName
-					}
-					log.Printf("[%s] %s: %v", w.workerID, fileName, err)
-					// Отклоняем сообщение без возврата в очередь
-					d.Nack(false, false)
-				}
+	if err != nil {
+		// Импорт прерван остановкой воркера: транзакция откачена, возвращаем задачу в очередь
+		// без увеличения счетчика попыток
+		if w.interrupted(err) {
+			logger.Warn("Импорт прерван остановкой воркера, задача возвращена в очередь")
+			w.failJob(logger, jobID, err, false)
+			w.requeue(d, jobID, logger)
+			return
+		}
+
+		// Проверяем, является ли ошибка deadlock или временной
+		isRetryable := isRetryableError(err)
+		
+		if isRetryable && retryCount < w.retryPolicy.MaxRetries {
+			if isDeadlockError(err) {
+				deadlockRetries.WithLabelValues("import").Inc()
+			}
+
+			// Откладываем повторную попытку через очередь задержки (экспоненциальная задержка с jitter),
+			// не блокируя обработку других сообщений
+			if retryErr := w.scheduleRetry(d, retryCount+1, jobID); retryErr != nil {
+				logger.Error("Ошибка планирования повторной попытки", "error", retryErr)
+				// Fallback к обычному requeue если перепубликация не удалась
+				w.nack(d, true, logger)
 			} else {
-				// Подтверждаем обработку
-				d.Ack(false)
+				// Подтверждаем старое сообщение после успешной перепубликации
+				logger.Warn("Временная ошибка импорта, задача отложена для повторной попытки",
+					"error", err, "attempt", retryCount+1)
+				messagesRetried.WithLabelValues(w.queueName).Inc()
+				w.ack(d, logger)
+			}
+			w.failJob(logger, jobID, err, false)
+		} else {
+			logger.Error("Ошибка импорта", "error", err, "attempt", retryCount+1)
+			w.failJob(logger, jobID, err, true)
+
+			result.Status = JobStatusFailed
+			result.Error = err.Error()
+			w.publishResult(d, result, logger)
+
+			// Отправляем сообщение в dead-letter очередь с причиной ошибки
+			if dlErr := w.deadLetter(d, err, retryCount); dlErr != nil {
+				logger.Error("Ошибка отправки в dead-letter очередь", "error", dlErr)
+				// Отклоняем сообщение без возврата в очередь
+				// (попадет в dead-letter exchange по политике очереди без заголовков с причиной)
+				w.nack(d, false, logger)
+			} else {
+				messagesDeadLettered.WithLabelValues(w.queueName).Inc()
+				w.ack(d, logger)
 			}
 		}
-	}()
+	} else {
+		// Подтверждаем обработку после публикации результата
+		w.publishResult(d, result, logger)
+		w.ack(d, logger)
+	}
+}
+
+// interrupted сообщает, что обработка завершилась ошибкой из-за остановки воркера.
+// После отмены контекста импорта запрос может завершиться не context.Canceled, а ошибкой драйвера
+// или sql.ErrTxDone (транзакцию уже откатил database/sql), поэтому проверяется и сам контекст
+func (w *Worker) interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || w.importCtx.Err() != nil
+}
+
+// ack подтверждает сообщение и учитывает его в метриках
+func (w *Worker) ack(d amqp.Delivery, logger *slog.Logger) {
+	if err := d.Ack(false); err != nil {
+		logger.Error("Ошибка подтверждения сообщения", "error", err)
+		return
+	}
+	messagesAcked.WithLabelValues(w.queueName).Inc()
+}
+
+// nack отклоняет сообщение (с возвратом в очередь, если requeue) и учитывает его в метриках
+func (w *Worker) nack(d amqp.Delivery, requeue bool, logger *slog.Logger) {
+	if err := d.Nack(false, requeue); err != nil {
+		logger.Error("Ошибка отклонения сообщения", "error", err)
+		return
+	}
+	messagesNacked.WithLabelValues(w.queueName, strconv.FormatBool(requeue)).Inc()
+}
+
+// declareDeadLetter объявляет dead-letter exchange и очередь для необработанных задач
+func declareDeadLetter(ch *amqp.Channel, exchange string, queue string) error {
+	if err := ch.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	); err != nil {
+		return fmt.Errorf("ошибка объявления dead-letter exchange: %w", err)
+	}
+
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("ошибка объявления dead-letter очереди: %w", err)
+	}
+
+	if err := ch.QueueBind(queue, "", exchange, false, nil); err != nil {
+		return fmt.Errorf("ошибка привязки dead-letter очереди: %w", err)
+	}
 
-	<-forever
 	return nil
 }
 
-// processMessage обрабатывает одно сообщение
-func (w *Worker) processMessage(d amqp.Delivery) error {
+// deadLetter публикует сообщение в dead-letter exchange с заголовками о причине ошибки.
+// Routing key - исходная очередь, поэтому сообщение можно переотправить в неё без изменений
+func (w *Worker) deadLetter(d amqp.Delivery, cause error, retryCount int) error {
+	headers := make(amqp.Table)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	reason := cause.Error()
+	if len(reason) > deadLetterReasonMaxLength {
+		reason = strings.ToValidUTF8(reason[:deadLetterReasonMaxLength], "")
+	}
+
+	headers["x-error"] = reason
+	headers["x-retry-count"] = retryCount
+	headers["x-worker-id"] = w.workerID
+	headers["x-failed-at"] = time.Now()
+	headers["x-original-queue"] = w.queueName
+
+	err := w.currentChannel().Publish(
+		w.deadLetterExchange, // exchange
+		w.queueName,          // routing key
+		false,                // mandatory
+		false,                // immediate
+		amqp.Publishing{
+			Body:          d.Body,
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			Priority:      d.Priority,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Timestamp:     time.Now(),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("ошибка публикации в dead-letter очередь: %w", err)
+	}
+	return nil
+}
+
+// logDryRun выводит итоги проверочного импорта
+func (w *Worker) logDryRun(logger *slog.Logger, report *DryRunReport, duration time.Duration) {
+	logger.Info("Проверка без записи завершена",
+		"duration_s", duration.Seconds(),
+		"rows", report.Rows,
+		"rejected", report.Rejected,
+		"companies_new", report.Companies.New,
+		"companies_existing", report.Companies.Existing,
+		"cities_new", report.Dictionaries["city"].New,
+		"categories_new", report.Dictionaries["category"].New)
+
+	if report.AlreadyImported {
+		logger.Info("Файл уже был импортирован", "duplicate_of", report.DuplicateOf)
+	}
+	for field, count := range report.Truncated {
+		logger.Warn("Значения поля длиннее колонки БД", "field", field, "count", count)
+	}
+	if report.RejectsPath != "" {
+		logger.Info("Отклоненные строки сохранены", "path", report.RejectsPath)
+	}
+}
+
+// taskLogger возвращает логгер с полями задачи: каждая запись об импорте содержит
+// worker_id, queue, message_id, job_id и file_name
+func (w *Worker) taskLogger(d amqp.Delivery, jobID int64) *slog.Logger {
+	var task ImportTask
+	json.Unmarshal(d.Body, &task)
+
+	return w.logger.With(logFieldMessageID, d.MessageId, logFieldJobID, jobID, logFieldFileName, task.FileName)
+}
+
+// resolveJob возвращает ID задачи импорта из заголовков или тела сообщения,
+// либо создает новую запись в import_job. Ошибки учета задач не прерывают импорт,
+// поэтому при ошибке возвращается 0 (задача не отслеживается)
+func (w *Worker) resolveJob(d amqp.Delivery) int64 {
+	if jobID := getJobID(d.Headers); jobID > 0 {
+		return jobID
+	}
+
+	var task ImportTask
+	if err := json.Unmarshal(d.Body, &task); err != nil {
+		return 0
+	}
+	if task.JobID > 0 {
+		return task.JobID
+	}
+
+	jobID, err := w.jobs.Create(task, d.MessageId)
+	if err != nil {
+		w.logger.Error("Ошибка учета задачи импорта", logFieldMessageID, d.MessageId, logFieldFileName, task.FileName, "error", err)
+		return 0
+	}
+	return jobID
+}
+
+// failJob сохраняет ошибку задачи импорта, ошибки учета только логируются
+func (w *Worker) failJob(logger *slog.Logger, jobID int64, cause error, final bool) {
+	if err := w.jobs.Fail(jobID, cause, final); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+}
+
+// setJobProgress сохраняет количество обработанных строк задачи импорта, ошибки учета только логируются
+func (w *Worker) setJobProgress(logger *slog.Logger, jobID int64, rows int) {
+	if err := w.jobs.Progress(jobID, rows); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+}
+
+// setJobStatus меняет статус задачи импорта, ошибки учета только логируются
+func (w *Worker) setJobStatus(logger *slog.Logger, jobID int64, status string) {
+	if err := w.jobs.SetStatus(jobID, status); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+}
+
+// processMessage обрабатывает одно сообщение и заполняет результат для события о завершении импорта.
+// logger принадлежит handleDelivery: после создания записи import_batch в него добавляется её ID
+func (w *Worker) processMessage(ctx context.Context, d amqp.Delivery, jobID int64, result *ImportResult, logger *slog.Logger) error {
 	var task ImportTask
 	if err := json.Unmarshal(d.Body, &task); err != nil {
 		return fmt.Errorf("ошибка декодирования задачи: %w", err)
 	}
+	result.Task = &task
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("import.file_name", task.FileName))
 
-	fileSizeKB := float64(task.FileSize) / 1024.0 / 1024.0
-	log.Printf("[%s] Задача: %.4f МБ, файл: %s, старт...", w.workerID, fileSizeKB, task.FileName)
+	fileSizeMB := float64(task.FileSize) / 1024.0 / 1024.0
+	logger.Info("Задача получена, старт импорта", "file_size_mb", fileSizeMB)
 
 	// Определяем полный путь к файлу
 	filePath := task.FilePath
@@ -219,26 +513,220 @@ func (w *Worker) processMessage(d amqp.Delivery) error {
 		}
 	}
 
-	// Парсим CSV файл
-	records, err := w.csvParser.ParseFile(filePath)
+	// Контрольная сумма защищает от повторного импорта того же файла: при повторной публикации
+	// задачи API или если воркер упал после коммита, но до подтверждения сообщения
+	contentHash, err := fileChecksum(filePath)
 	if err != nil {
 		return fmt.Errorf("%s: %w", task.FileName, err)
 	}
-
-	if len(records) == 0 {
+	var imported *ImportRecord
+	if !task.Force {
+		imported, err = w.dedup.Find(contentHash, d.MessageId)
+		if err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+	}
+	// Проверочный импорт выполняется и для уже импортированного файла, повтор отмечается в отчете
+	if imported != nil && !task.DryRun {
+		w.skipImported(logger, jobID, imported, filePath, result)
 		return nil
 	}
 
+	if err := w.jobs.Start(jobID, w.workerID); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+
+	// Сопоставление колонок из задачи имеет приоритет над настройками воркера
+	parser := w.csvParser
+	if task.ColumnMapping != nil {
+		if err := task.ColumnMapping.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+		parser = parser.WithMapping(task.ColumnMapping)
+	}
+
+	// Правила проверки строк из задачи имеют приоритет над настройками воркера
+	if task.Validation != nil {
+		if err := task.Validation.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+		parser = parser.WithValidation(task.Validation)
+	}
+
+	// Режим импорта: по умолчанию только добавление новых данных
+	mode := task.Mode
+	switch mode {
+	case "":
+		mode = ImportModeInsert
+	case ImportModeInsert, ImportModeUpsert:
+	case ImportModeSync:
+		if task.Sync == nil {
+			return fmt.Errorf("%s: для режима sync нужно указать область выгрузки (sync)", task.FileName)
+		}
+		if err := task.Sync.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+		task.Sync.ApplyDefaults(w.syncMaxRemovePercent)
+	default:
+		return fmt.Errorf("%s: неизвестный режим импорта: %s", task.FileName, task.Mode)
+	}
+
+	// Разделитель и кодировка из задачи имеют приоритет над автоопределением
+	if task.Delimiter != "" || task.Encoding != "" {
+		formatted, err := parser.WithFormat(task.Delimiter, task.Encoding)
+		if err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+		parser = formatted
+	}
+
+	// Парсим CSV файл порциями по batchSize записей и сразу передаем их в репозиторий,
+	// не загружая весь файл в память. При повторной попытке файл перечитывается заново.
+	// Отклоненные строки записываются в файл рядом с исходным
+	var stats ParseStats
+	var rejectsPath string
+	source := func(ctx context.Context, handle func(batch []GisCompany) error) error {
+		rejects := NewRejectsWriter(filePath)
+		if err := rejects.Reset(); err != nil {
+			return err
+		}
+		inserting := false
+		processed := 0
+		track := func(batch []GisCompany) error {
+			// Статус inserting выставляется при передаче первой порции в БД
+			if !inserting && !task.DryRun {
+				inserting = true
+				w.setJobStatus(logger, jobID, JobStatusInserting)
+			}
+			// Каждая порция - продвижение импорта для проверки живости
+			w.touchProgress()
+			if err := handle(batch); err != nil {
+				return err
+			}
+
+			// Количество обработанных строк обновляется после каждой порции, чтобы прогресс был виден до конца импорта
+			processed += len(batch)
+			w.setJobProgress(logger, jobID, processed)
+			return nil
+		}
+
+		var err error
+		stats, err = parser.ParseFileInBatches(ctx, filePath, w.batchSize, track, rejects.Write)
+		if closeErr := rejects.Close(); err == nil {
+			err = closeErr
+		}
+		if rejects.Count() > 0 {
+			rejectsPath = rejects.Path()
+		}
+
+		// Отклоненная строка может описывать компанию выгрузки: без неё компания считалась бы отсутствующей
+		// в файле и была бы удалена, поэтому синхронизация по файлу с отклоненными строками не выполняется
+		if err == nil && mode == ImportModeSync && !task.DryRun && stats.Rejected > 0 {
+			err = fmt.Errorf("синхронизация остановлена: отклонено строк - %d (%s), в режиме sync все строки файла должны пройти проверку",
+				stats.Rejected, rejectsPath)
+		}
+		return err
+	}
+
 	startTime := time.Now()
-	if err := w.repository.Insert(records); err != nil {
+
+	// Проверочный импорт только читает БД. Файл не удаляется, чтобы его можно было импортировать после проверки
+	if task.DryRun {
+		report, err := w.repository.DryRun(ctx, source)
+		if err != nil {
+			return fmt.Errorf("%s: %w", task.FileName, err)
+		}
+		report.Rows = stats.Rows
+		report.Rejected = stats.Rejected
+		report.RejectsPath = rejectsPath
+		if imported != nil {
+			report.AlreadyImported = true
+			report.DuplicateOf = imported.JobID
+		}
+
+		duration := time.Since(startTime)
+		w.logDryRun(logger, report, duration)
+
+		if err := w.jobs.Finish(jobID, stats, rejectsPath, report, duration); err != nil {
+			logger.Error("Ошибка учета задачи импорта", "error", err)
+		}
+		result.Status = JobStatusDone
+		result.Summary = report
+		return nil
+	}
+
+	// Контрольная сумма сохраняется в той же транзакции, что и данные.
+	// ID импорта для отката добавляется ко всем записям задачи сразу после создания import_batch:
+	// логгер меняется по указателю, поэтому поле получают и записи handleDelivery после импорта.
+	// При повторной попытке поле заменяется ID новой записи import_batch
+	taskLogger := *logger
+	opts := ImportOptions{
+		Mode: mode,
+		Sync: task.Sync,
+		Batch: &ImportBatch{
+			JobID:       jobID,
+			FileName:    task.FileName,
+			ContentHash: contentHash,
+		},
+		OnBatch: func(batchID int64) {
+			*logger = *taskLogger.With(logFieldImportBatch, batchID)
+		},
+		BeforeCommit: func(tx *sql.Tx) error {
+			return w.dedup.Record(tx, contentHash, d.MessageId, jobID, task.FileName, task.Force)
+		},
+	}
+	if err := w.repository.InsertStream(ctx, source, opts); err != nil {
+		// Тот же файл параллельно импортировала другая задача и закоммитила раньше: наша транзакция откачена
+		if errors.Is(err, ErrAlreadyImported) {
+			imported, findErr := w.dedup.Find(contentHash, d.MessageId)
+			if findErr != nil {
+				return fmt.Errorf("%s: %w", task.FileName, findErr)
+			}
+			if imported == nil {
+				imported = &ImportRecord{ContentHash: contentHash}
+			}
+			w.skipImported(logger, jobID, imported, filePath, result)
+			return nil
+		}
 		return fmt.Errorf("%s: %w", task.FileName, err)
 	}
 
 	duration := time.Since(startTime)
 	summary := w.repository.GetSummary()
+	summary.Rows = stats.Rows
+	summary.Rejected = stats.Rejected
 
-	log.Printf("[%s] Успешно: %.2fс, Строк: %d, Файл: %s, Компаний: %d, Городов: %d, Катег: %d, Подкатег: %d.",
-		w.workerID, duration.Seconds(), len(records), task.FileName, summary.Company, summary.City, summary.Category, summary.Subcategory)
+	logger.Info("Импорт завершен",
+		"mode", mode,
+		"duration_s", duration.Seconds(),
+		"rows", stats.Rows,
+		"rejected", stats.Rejected,
+		"companies_inserted", summary.Companies.Inserted,
+		"companies_matched", summary.Companies.Matched,
+		"cities_new", summary.Dictionaries["city"].New,
+		"categories_new", summary.Dictionaries["category"].New,
+		"subcategories_new", summary.Dictionaries["subcategory"].New,
+		"links_geo", summary.Links["company_geo"],
+		"links_category", summary.Links["company_category"],
+		"links_subcategory", summary.Links["company_subcategory"],
+		"contacts", summary.Links["company_contact"])
+
+	if mode == ImportModeUpsert || mode == ImportModeSync {
+		logger.Info("Компании обновлены", "updated", summary.Updated, "restored", summary.Restored)
+	}
+	if mode == ImportModeSync {
+		logger.Info("Удалены компании, отсутствующие в выгрузке", "removed", summary.Removed)
+	}
+
+	if rejectsPath != "" {
+		logger.Info("Отклоненные строки сохранены", "path", rejectsPath)
+	}
+
+	if err := w.jobs.Finish(jobID, stats, rejectsPath, summary, duration); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+	result.Status = JobStatusDone
+	result.Summary = summary
 
 	// Удаляем обработанный файл
 	os.Remove(filePath)
@@ -246,6 +734,18 @@ func (w *Worker) processMessage(d amqp.Delivery) error {
 	return nil
 }
 
+// skipImported завершает задачу без импорта: файл уже импортирован в задаче imported.JobID
+func (w *Worker) skipImported(logger *slog.Logger, jobID int64, imported *ImportRecord, filePath string, result *ImportResult) {
+	logger.Info("Файл уже импортирован, пропускаем",
+		"imported_at", imported.ImportedAt.Format("2006-01-02 15:04:05"), "duplicate_of", imported.JobID, "imported_file_name", imported.FileName)
+	if err := w.jobs.Skip(jobID, imported.JobID); err != nil {
+		logger.Error("Ошибка учета задачи импорта", "error", err)
+	}
+	os.Remove(filePath)
+	result.Status = JobStatusSkipped
+	result.DuplicateOf = imported.JobID
+}
+
 // getRetryCount получает количество попыток из заголовков сообщения
 func getRetryCount(headers amqp.Table) int {
 	if headers == nil {
@@ -260,6 +760,29 @@ func getRetryCount(headers amqp.Table) int {
 	return 0
 }
 
+// getJobID получает ID задачи импорта из заголовков сообщения
+func getJobID(headers amqp.Table) int64 {
+	if headers == nil {
+		return 0
+	}
+	switch id := headers["x-import-job-id"].(type) {
+	case int64:
+		return id
+	case int32:
+		return int64(id)
+	case int:
+		return int64(id)
+	}
+	return 0
+}
+
+// isDeadlockError проверяет, является ли ошибка deadlock MySQL
+func isDeadlockError(err error) bool {
+	errStr := err.Error()
+	return strings.Contains(errStr, "Deadlock") || strings.Contains(errStr, "deadlock") ||
+		strings.Contains(errStr, "Error 1213")
+}
+
 // isRetryableError проверяет, можно ли повторить операцию при данной ошибке
 func isRetryableError(err error) bool {
 	if err == nil {
@@ -300,16 +823,67 @@ func isRetryableError(err error) bool {
 	return false
 }
 
-// Close закрывает соединения
-func (w *Worker) Close() error {
-	if w.channel != nil {
-		if err := w.channel.Close(); err != nil {
-			return err
+// beginDelivery регистрирует обрабатываемое сообщение.
+// Возвращает false, если воркер уже начал остановку
+func (w *Worker) beginDelivery() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closing {
+		return false
+	}
+	w.inflight.Add(1)
+	return true
+}
+
+// stop помечает воркер как останавливаемый и прерывает ожидание переподключения
+func (w *Worker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closing {
+		w.closing = true
+		close(w.done)
+	}
+}
+
+// Shutdown плавно останавливает воркер: отменяет потребителя, ждет завершения текущего импорта
+// (с подтверждением сообщения) и только после этого закрывает свой канал RabbitMQ.
+// Если импорт не завершился до истечения ctx, он отменяется: транзакция откатывается,
+// а сообщение возвращается в очередь
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.stop()
+
+	// Брокер перестает доставлять новые сообщения, канал остается открытым для ack/nack
+	if ch := w.currentChannel(); ch != nil && !ch.IsClosed() {
+		if err := ch.Cancel(w.workerID, false); err != nil {
+			w.logger.Error("Ошибка отмены потребителя", "error", err)
 		}
 	}
-	if w.conn != nil {
-		return w.conn.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		w.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		w.logger.Warn("Импорт не завершился за отведенное время, откатываем")
+		w.cancelImport()
+		<-drained
 	}
-	return nil
+
+	// Уведомления о завершенных импортах досылаются в пределах того же времени
+	w.webhooks.Wait(ctx)
+
+	w.cancelImport()
+	return w.closeChannel()
+}
+
+// Close немедленно останавливает воркер: отменяет текущий импорт и закрывает канал
+func (w *Worker) Close() error {
+	w.stop()
+	w.cancelImport()
+	return w.closeChannel()
 }
 
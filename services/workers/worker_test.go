@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testAcknowledger запоминает ответы воркера брокеру
+type testAcknowledger struct {
+	nacked chan bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error { return nil }
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked <- requeue
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestConsumeLoopSkipsDeliveriesDuringShutdown(t *testing.T) {
+	w := &Worker{
+		queueName: "csv_import_shutdown_test",
+		done:      make(chan struct{}),
+		closing:   true,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	msgs := make(chan amqp.Delivery)
+	stopped := make(chan struct{})
+	go func() {
+		w.consumeLoop(msgs)
+		close(stopped)
+	}()
+
+	// Сообщение, полученное после начала остановки, возвращается в очередь и не считается полученным
+	acknowledger := &testAcknowledger{nacked: make(chan bool, 1)}
+	msgs <- amqp.Delivery{Acknowledger: acknowledger}
+	select {
+	case requeue := <-acknowledger.nacked:
+		if !requeue {
+			t.Error("сообщение должно возвращаться в очередь")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("сообщение не отклонено")
+	}
+	close(w.done)
+	<-stopped
+
+	var consumed dto.Metric
+	if err := messagesConsumed.WithLabelValues(w.queueName).Write(&consumed); err != nil {
+		t.Fatal(err)
+	}
+	if value := consumed.GetCounter().GetValue(); value != 0 {
+		t.Errorf("messages_consumed: ожидалось 0, получено %v", value)
+	}
+}
+
+func TestHandleDeliveryLogsImportBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Задача без учета в import_job, файл ранее не импортировался
+	mock.ExpectExec("INSERT INTO csv.import_job").WillReturnError(errors.New("Error 1146: Table 'csv.import_job' doesn't exist"))
+	mock.ExpectQuery("FROM csv.import_dedup").WillReturnError(sql.ErrNoRows)
+	// Импорт создает запись import_batch и прерывается остановкой воркера на первой порции
+	mock.ExpectBegin()
+	mock.ExpectExec("SET FOREIGN_KEY_CHECKS = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO csv.import_batch").WillReturnResult(sqlmock.NewResult(17, 1))
+	mock.ExpectQuery("SELECT id, name FROM csv.company").
+		WillDelayFor(5 * time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	mock.ExpectRollback()
+
+	var output bytes.Buffer
+	importCtx, cancelImport := context.WithCancel(context.Background())
+	w := &Worker{
+		importCtx:  importCtx,
+		repository: NewCompanyRepository(db, 0),
+		jobs:       NewJobRepository(db),
+		dedup:      NewDedupRepository(db),
+		queueName:  "csv_import_normal",
+		batchSize:  100,
+		csvParser:  NewCSVParser(nil, nil),
+		logger:     slog.New(slog.NewJSONHandler(&output, nil)),
+	}
+
+	task, _ := json.Marshal(ImportTask{FileName: "companies.csv", FilePath: writeTestFile(t, []byte("Название\nКомпания\n"))})
+	acknowledger := &testAcknowledger{nacked: make(chan bool, 1)}
+	time.AfterFunc(50*time.Millisecond, cancelImport)
+	w.handleDelivery(amqp.Delivery{Acknowledger: acknowledger, MessageId: "message-1", Body: task})
+
+	if requeue := <-acknowledger.nacked; !requeue {
+		t.Error("прерванная задача должна возвращаться в очередь")
+	}
+
+	// Запись handleDelivery после возврата из processMessage содержит ID импорта
+	var interrupted map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("некорректная запись лога %q: %v", line, err)
+		}
+		if entry["msg"] == "Импорт прерван остановкой воркера, задача возвращена в очередь" {
+			interrupted = entry
+		}
+	}
+	if interrupted == nil {
+		t.Fatalf("запись о прерванном импорте не найдена:\n%s", output.String())
+	}
+	if interrupted[logFieldImportBatch] != float64(17) {
+		t.Errorf("запись о прерванном импорте без %s: %v", logFieldImportBatch, interrupted)
+	}
+}